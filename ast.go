@@ -3,17 +3,21 @@ package gocalc
 import (
 	"encoding/json"
 	"fmt"
+	"unicode/utf8"
 )
 
 type Expr interface {
 	String() string
+	Pos() Position // position of first character belonging to the node
+	End() Position // position of first character immediately after the node
 }
 
 type (
 	LiteralExpr struct {
-		Kind    Token
-		Literal string
-		Date    interface{}
+		Kind     Token
+		Literal  string
+		Date     interface{}
+		ValuePos Position `json:"-"`
 	}
 
 	AccessExpr struct {
@@ -22,30 +26,162 @@ type (
 	}
 
 	IndexExpr struct {
-		E     Expr
-		Index Expr
+		E      Expr
+		Index  Expr
+		Lbrack Position `json:"-"`
+		Rbrack Position `json:"-"`
+	}
+
+	// SliceExpr is the part of E from Lo up to Hi excluded, as in s[1:3].
+	// Either bound may be nil: s[:3], s[1:].
+	SliceExpr struct {
+		E      Expr
+		Lo     Expr
+		Hi     Expr
+		Lbrack Position `json:"-"`
+		Rbrack Position `json:"-"`
 	}
 
 	IdentExpr struct {
-		Name string
+		Name    string
+		NamePos Position `json:"-"`
 	}
 
 	BinaryExpr struct {
-		LE Expr
-		Op Token
-		RE Expr
+		LE    Expr
+		Op    Token
+		RE    Expr
+		OpPos Position `json:"-"`
 	}
 
 	ParenExpr struct {
-		E Expr
+		E      Expr
+		Lparen Position `json:"-"`
+		Rparen Position `json:"-"`
 	}
 
 	UnaryExpr struct {
-		Op Token
-		E  Expr
+		Op    Token
+		E     Expr
+		OpPos Position `json:"-"`
+	}
+
+	// LetExpr binds Name to Value for the statements after it.
+	LetExpr struct {
+		Name   IdentExpr
+		Value  Expr
+		LetPos Position `json:"-"`
+	}
+
+	// AssignExpr stores Value into Target, which is an IdentExpr,
+	// AccessExpr or IndexExpr. With += and -=, Target is combined with
+	// Value first.
+	AssignExpr struct {
+		Target Expr
+		Op     Token
+		Value  Expr
+		OpPos  Position `json:"-"`
+	}
+
+	// LambdaExpr is an anonymous function such as x => x * 2 or
+	// (acc, x) => acc + x. Its value closes over the variables in scope.
+	LambdaExpr struct {
+		Params []IdentExpr
+		Body   Expr
+		Lparen Position `json:"-"` // invalid without parentheses
+		Arrow  Position `json:"-"`
+	}
+
+	// CallExpr calls a built-in function or a lambda.
+	CallExpr struct {
+		Fun    Expr
+		Args   []Expr
+		Lparen Position `json:"-"`
+		Rparen Position `json:"-"`
+	}
+
+	// UnitExpr is a number annotated with a unit of measure, as in 5 kg
+	// or 9.8 m/s^2.
+	UnitExpr struct {
+		X       Expr
+		Unit    string
+		UnitPos Position `json:"-"`
+	}
+
+	// Program is a script of statements separated by semicolons, whose
+	// value is the value of the last statement.
+	Program struct {
+		Stmts []Expr
 	}
 )
 
+func (e *LiteralExpr) Pos() Position { return e.ValuePos }
+func (e *AccessExpr) Pos() Position  { return posOf(e.E, e.Access.NamePos) }
+func (e *IndexExpr) Pos() Position   { return posOf(e.E, e.Lbrack) }
+func (e *SliceExpr) Pos() Position   { return posOf(e.E, e.Lbrack) }
+func (e *IdentExpr) Pos() Position   { return e.NamePos }
+func (e *BinaryExpr) Pos() Position  { return posOf(e.LE, e.OpPos) }
+func (e *ParenExpr) Pos() Position   { return e.Lparen }
+func (e *UnaryExpr) Pos() Position   { return e.OpPos }
+func (e *LetExpr) Pos() Position     { return e.LetPos }
+func (e *AssignExpr) Pos() Position  { return posOf(e.Target, e.OpPos) }
+func (e *CallExpr) Pos() Position    { return posOf(e.Fun, e.Lparen) }
+func (e *UnitExpr) Pos() Position    { return posOf(e.X, e.UnitPos) }
+func (e *LambdaExpr) Pos() Position {
+	if e.Lparen.IsValid() || len(e.Params) == 0 {
+		return e.Lparen
+	}
+	return e.Params[0].NamePos
+}
+func (e *Program) Pos() Position {
+	if len(e.Stmts) == 0 {
+		return Position{}
+	}
+	return posOf(e.Stmts[0], Position{})
+}
+
+func (e *LiteralExpr) End() Position {
+	return e.ValuePos.advance(utf8.RuneCountInString(e.Literal))
+}
+func (e *AccessExpr) End() Position { return e.Access.End() }
+func (e *IndexExpr) End() Position  { return e.Rbrack.advance(1) }
+func (e *SliceExpr) End() Position  { return e.Rbrack.advance(1) }
+func (e *IdentExpr) End() Position {
+	return e.NamePos.advance(utf8.RuneCountInString(e.Name))
+}
+func (e *BinaryExpr) End() Position { return endOf(e.RE, e.OpPos.advance(len(e.Op.String()))) }
+func (e *ParenExpr) End() Position  { return e.Rparen.advance(1) }
+func (e *UnaryExpr) End() Position  { return endOf(e.E, e.OpPos.advance(len(e.Op.String()))) }
+func (e *LetExpr) End() Position    { return endOf(e.Value, e.Name.End()) }
+func (e *CallExpr) End() Position   { return e.Rparen.advance(1) }
+func (e *UnitExpr) End() Position   { return e.UnitPos.advance(utf8.RuneCountInString(e.Unit)) }
+func (e *LambdaExpr) End() Position { return endOf(e.Body, e.Arrow.advance(2)) }
+func (e *AssignExpr) End() Position {
+	return endOf(e.Value, e.OpPos.advance(len(e.Op.String())))
+}
+func (e *Program) End() Position {
+	if len(e.Stmts) == 0 {
+		return Position{}
+	}
+	return endOf(e.Stmts[len(e.Stmts)-1], Position{})
+}
+
+// posOf and endOf fall back to def for the missing children of partial
+// trees returned alongside a syntax error.
+func posOf(e Expr, def Position) Position {
+	if e == nil {
+		return def
+	}
+	return e.Pos()
+}
+
+func endOf(e Expr, def Position) Position {
+	if e == nil {
+		return def
+	}
+	return e.End()
+}
+
 func (e *LiteralExpr) String() string {
 	b, _ := json.Marshal(e)
 	return string(b)
@@ -60,6 +196,11 @@ func (e *IndexExpr) String() string {
 	return string(b)
 }
 
+func (e *SliceExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+
 func (e *IdentExpr) String() string {
 	b, _ := json.Marshal(e)
 	return string(b)
@@ -77,6 +218,30 @@ func (e *UnaryExpr) String() string {
 	b, _ := json.Marshal(e)
 	return string(b)
 }
+func (e *LetExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+func (e *AssignExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+func (e *LambdaExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+func (e *CallExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+func (e *UnitExpr) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
+func (e *Program) String() string {
+	b, _ := json.Marshal(e)
+	return string(b)
+}
 
 func PrintAst(e Expr) {
 	b, _ := json.MarshalIndent(e, "", "    ")
@@ -0,0 +1,321 @@
+package gocalc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVariables(t *testing.T) {
+	deps := NewExpression(`user.address.city + items[i].price * (items[0].qty + m["k"]) - -total`).Variables()
+
+	wantNames := []string{"i", "items", "m", "total", "user"}
+	wantPaths := []string{"i", `items[*].price`, `items[0].qty`, `m["k"]`, "total", "user.address.city"}
+	if !reflect.DeepEqual(deps.Names, wantNames) {
+		t.Errorf("names: got %v, want %v", deps.Names, wantNames)
+	}
+	if !reflect.DeepEqual(deps.Paths, wantPaths) {
+		t.Errorf("paths: got %v, want %v", deps.Paths, wantPaths)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	src := `let f = x => x * 2; f(sum(map(items, x => x.qty))) + name.trim().len() + ((g, x) => g(x))(abs, -1) + rate(1)`
+	deps := NewExpression(src).Variables()
+
+	want := []string{"len", "map", "rate", "sum", "trim"}
+	if !reflect.DeepEqual(deps.Functions, want) {
+		t.Errorf("functions: got %v, want %v", deps.Functions, want)
+	}
+	if want := []string{"abs", "items", "name", "rate"}; !reflect.DeepEqual(deps.Names, want) {
+		t.Errorf("names: got %v, want %v", deps.Names, want)
+	}
+	if deps := NewExpression(`a + b`).Variables(); len(deps.Functions) != 0 {
+		t.Errorf("got %v, want no functions", deps.Functions)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	var idents []string
+	Inspect(ParserAST(`a.b + c[d] * -(e)`), func(e Expr) bool {
+		if id, ok := e.(*IdentExpr); ok {
+			idents = append(idents, id.Name)
+		}
+		return true
+	})
+
+	want := []string{"a", "b", "c", "d", "e"}
+	if !reflect.DeepEqual(idents, want) {
+		t.Errorf("got %v, want %v", idents, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	orig := ParserAST(`price * qty + price.tax`)
+	before := orig.String()
+
+	renamed := Rewrite(orig, func(e Expr) Expr {
+		if id, ok := e.(*IdentExpr); ok && id.Name == "price" {
+			return &IdentExpr{Name: "cost"}
+		}
+		return e
+	})
+
+	deps := (&Expression{Expr: renamed}).Variables()
+	if want := []string{"cost", "cost.tax", "qty"}; !reflect.DeepEqual(deps.Paths, want) {
+		t.Errorf("got %v, want %v", deps.Paths, want)
+	}
+	if orig.String() != before {
+		t.Errorf("rewrite modified the original tree")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{`a+b*c`, `a + b * c`},
+		{`(a+b)*c`, `(a + b) * c`},
+		{`((a))-(b-c)`, `a - (b - c)`},
+		{`(a-b)-c`, `a - b - c`},
+		{`-(a+b) * -c`, `-(a + b) * -c`},
+		{`(-a).b[ (i+1) ]`, `(-a).b[i + 1]`},
+		{`x.y == "q\"\t" && !ok || 2.50 >= 1.0`, `x.y == "q\"\t" && !ok || 2.5 >= 1.0`},
+		{`a <<  b >> 1 | c & d ^ e`, `a << b >> 1 | c & d ^ e`},
+		{`let t=(a+b) ;t*t;`, `let t = a + b; t * t`},
+		{`due-now()<1h30m && 1.5s.seconds()>0`, `due - now() < 1h30m0s && 1.5s.seconds() > 0`},
+		{`(9.8   m/s^2)*t/2 kg`, `9.8 m/s^2 * t / 2 kg`},
+		{`0.1000000000001 + 2.50`, `0.1000000000001 + 2.5`},
+		{`sum(map(filter(xs,x->x>1),(x)=>(x*2)))`, `sum(map(filter(xs, x => x > 1), x => x * 2))`},
+		{`reduce(xs,(a,b)=>(a,b),(0,1)) + (x => x)(2)`, `reduce(xs, (a, b) => (a, b), (0, 1)) + (x => x)(2)`},
+		{`2**(3**2) + (2**3)**2 * -x**2`, `2 ** 3 ** 2 + (2 ** 3) ** 2 * -x ** 2`},
+		{`(-x)**2 + x**(-2) - -(x**2)`, `(-x) ** 2 + x ** -2 - -x ** 2`},
+		{`!(0!0)`, `!(0 ! 0)`},
+		{`~(1~2)`, `~(1 ~ 2)`},
+		{`(1.50+2.0i)*conj(z)`, `(1.5 + 2i) * conj(z)`},
+		{`s[ i+1 ]+(-s)[0]+'\x41'+'\n'`, `s[i + 1] + (-s)[0] + 'A' + '\n'`},
+		{`s[ 1 : n+1 ]+s[:2]+(-s)[i:]`, `s[1:n + 1] + s[:2] + (-s)[i:]`},
+		{`xs[-1]+xs[ -2: ][0]`, `xs[-1] + xs[-2:][0]`},
+	}
+	for _, c := range cases {
+		e, err := Parse(c.src)
+		if err != nil {
+			t.Errorf("%s: %v", c.src, err)
+			continue
+		}
+		got := Format(e)
+		if got != c.want {
+			t.Errorf("%s: got %s, want %s", c.src, got, c.want)
+		}
+
+		again, err := Parse(got)
+		if err != nil {
+			t.Errorf("%s: reparse: %v", got, err)
+			continue
+		}
+		if !reflect.DeepEqual(normalize(e), normalize(again)) {
+			t.Errorf("%s: round trip changed the tree", c.src)
+		}
+	}
+}
+
+func TestFormatComments(t *testing.T) {
+	cases := []struct {
+		src  string
+		want string
+	}{
+		{"/* rate */ a+b // total", "/* rate */ a + b // total"},
+		{"a /* net */ +b", "a /* net */ + b"},
+		{"a + /* gross */ b", "a + /* gross */ b"},
+		{"// check\n// limits\nx.y[1]>=2", "// check\n// limits\nx.y[1] >= 2"},
+		{"a + // first\n  b", "a // first\n+ b"},
+		{"(a /* in */) * 2", "a /* in */ * 2"},
+	}
+	for _, c := range cases {
+		e, comments, err := ParseWithComments(c.src, DefaultParseOptions)
+		if err != nil {
+			t.Errorf("%q: %v", c.src, err)
+			continue
+		}
+		got := FormatWithComments(e, NewCommentMap(e, comments))
+		if got != c.want {
+			t.Errorf("%q: got %q, want %q", c.src, got, c.want)
+		}
+		if Format(e) != Format(ParserAST(got)) {
+			t.Errorf("%q: comments changed the tree", got)
+		}
+	}
+
+	if _, err := Parse("a /* open"); err == nil {
+		t.Errorf("expected an error for an unterminated comment")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, src := range []string{``, `(a + b`, `a[1`, `a.`, `a b`, `1 +`, `"abc`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected a syntax error", src)
+		}
+	}
+}
+
+// normalize drops ParenExpr nodes, positions and literal spellings, which
+// Format does not preserve.
+func normalize(e Expr) Expr {
+	return Rewrite(e, func(e Expr) Expr {
+		switch ex := e.(type) {
+		case *ParenExpr:
+			return ex.E
+		case *LiteralExpr:
+			return &LiteralExpr{Kind: ex.Kind, Date: ex.Date}
+		case *IdentExpr:
+			return &IdentExpr{Name: ex.Name}
+		case *AccessExpr:
+			return &AccessExpr{E: ex.E, Access: IdentExpr{Name: ex.Access.Name}}
+		case *IndexExpr:
+			return &IndexExpr{E: ex.E, Index: ex.Index}
+		case *SliceExpr:
+			return &SliceExpr{E: ex.E, Lo: ex.Lo, Hi: ex.Hi}
+		case *BinaryExpr:
+			return &BinaryExpr{LE: ex.LE, Op: ex.Op, RE: ex.RE}
+		case *UnaryExpr:
+			return &UnaryExpr{Op: ex.Op, E: ex.E}
+		case *LetExpr:
+			return &LetExpr{Name: IdentExpr{Name: ex.Name.Name}, Value: ex.Value}
+		case *AssignExpr:
+			return &AssignExpr{Target: ex.Target, Op: ex.Op, Value: ex.Value}
+		case *LambdaExpr:
+			return &LambdaExpr{Params: ex.Params, Body: ex.Body}
+		case *CallExpr:
+			return &CallExpr{Fun: ex.Fun, Args: ex.Args}
+		case *UnitExpr:
+			return &UnitExpr{X: ex.X, Unit: ex.Unit}
+		}
+		return e
+	})
+}
+
+func TestPositions(t *testing.T) {
+	src := "a.b +\n  (-c[i]) * 10"
+	e, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string][2]string{}
+	Inspect(e, func(e Expr) bool {
+		if e != nil {
+			spans[Format(e)] = [2]string{e.Pos().String(), e.End().String()}
+		}
+		return true
+	})
+
+	want := map[string][2]string{
+		"a.b + -c[i] * 10": {"1:1", "2:15"},
+		"a.b":              {"1:1", "1:4"},
+		"-c[i] * 10":       {"2:3", "2:15"},
+		"-c[i]":            {"2:4", "2:9"},
+		"c[i]":             {"2:5", "2:9"},
+		"10":               {"2:13", "2:15"},
+	}
+	for src, span := range want {
+		if spans[src] != span {
+			t.Errorf("%s: got %v, want %v", src, spans[src], span)
+		}
+	}
+
+	_, err = Parse("a +\n  (b * )")
+	if perr, ok := err.(*Error); !ok || perr.Pos.String() != "2:8" {
+		t.Errorf("got %v, want a syntax error at 2:8", err)
+	}
+}
+
+func TestMarshalExpr(t *testing.T) {
+	src := `-(a.b[0] + 2.5) * x["k"] >= 10 || !(flag == true) && s + "\n" == ""`
+	e, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := MarshalExpr(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := UnmarshalExpr(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(normalize(e), normalize(loaded)) {
+		t.Errorf("round trip changed the tree:\n%s\n%s", Format(e), Format(loaded))
+	}
+
+	for _, bad := range []string{
+		`{"version":2,"expr":{"type":"ident","name":"a"}}`,
+		`{"version":1,"expr":{"type":"binary","op":"+","x":{"type":"ident","name":"a"}}}`,
+		`{"version":1,"expr":{"type":"binary","op":"(","x":{"type":"ident","name":"a"},"y":{"type":"ident","name":"b"}}}`,
+		`{"version":1,"expr":{"type":"literal","kind":"INTEGER","value":"1"}}`,
+		`{"version":1,"expr":{"type":"call"}}`,
+	} {
+		if _, err := UnmarshalExpr([]byte(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	src := `-(a.b[0] + 2.5) * x["k"] >= 10 || !(flag == true) && a.b + "\n" == a.b`
+	e, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Encode(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(normalize(e), normalize(loaded)) {
+		t.Errorf("round trip changed the tree:\n%s\n%s", Format(e), Format(loaded))
+	}
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if _, err := Decode(corrupt); err == nil {
+		t.Errorf("expected a checksum error")
+	}
+	if _, err := Decode(data[:len(data)-1]); err == nil {
+		t.Errorf("expected an error for truncated data")
+	}
+
+	deep, err := Parse(strings.Repeat("(", 50) + "1" + strings.Repeat(")", 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = Encode(deep)
+	defer func(n int) { MaxDecodeDepth = n }(MaxDecodeDepth)
+	MaxDecodeDepth = 40
+	if _, err := Decode(data); err == nil || !strings.Contains(err.Error(), "exceeds depth 40") {
+		t.Errorf("expected a depth error, got %v", err)
+	}
+	MaxDecodeDepth = 60
+	if _, err := Decode(data); err != nil {
+		t.Errorf("decode within depth: %v", err)
+	}
+
+	script, err := ParseWithOptions(`let t = a * 2; out.total = t; out.n += 1; reduce(xs, (s, x) => s + x, f()) + 90s; to(3.5 km/h, "m/s"); abs(3 + 2.5i ** 2); s[1] + s[n] + 'é'; s[1:] + s[:n] + s[:]`, ParseOptions{AllowAssign: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = Encode(script)
+	if loaded, err := Decode(data); err != nil || !reflect.DeepEqual(normalize(script), normalize(loaded)) {
+		t.Errorf("binary round trip changed the script: %v", err)
+	}
+	data, _ = MarshalExpr(script)
+	if loaded, err := UnmarshalExpr(data); err != nil || !reflect.DeepEqual(normalize(script), normalize(loaded)) {
+		t.Errorf("json round trip changed the script: %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// structPlan maps the names visible to an expression onto the field index
+// paths of a struct type. Plans are built once per type and cached.
+type structPlan struct {
+	fields map[string][]int
+}
+
+var structPlans sync.Map // reflect.Type -> *structPlan
+
+func planFor(t reflect.Type) *structPlan {
+	if plan, ok := structPlans.Load(t); ok {
+		return plan.(*structPlan)
+	}
+
+	plan := &structPlan{
+		fields: make(map[string][]int, t.NumField()),
+	}
+	depths := make(map[string]int, t.NumField())
+	plan.collect(t, nil, depths)
+
+	actual, _ := structPlans.LoadOrStore(t, plan)
+	return actual.(*structPlan)
+}
+
+// collect walks the fields of t, promoting the fields of untagged embedded
+// structs the same way encoding/json does: shallower fields win.
+func (plan *structPlan) collect(t reflect.Type, index []int, depths map[string]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, tagged := fieldName(f)
+		if name == "-" {
+			continue
+		}
+
+		path := make([]int, len(index)+1)
+		copy(path, index)
+		path[len(index)] = i
+
+		if f.Anonymous && !tagged {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				plan.collect(ft, path, depths)
+				continue
+			}
+		}
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		if depth, find := depths[name]; find && depth <= len(path) {
+			continue
+		}
+		depths[name] = len(path)
+		plan.fields[name] = path
+	}
+}
+
+// fieldName returns the name of a field as seen by expressions. A `calc` tag
+// takes precedence over a `json` tag, which takes precedence over the Go name.
+func fieldName(f reflect.StructField) (string, bool) {
+	for _, key := range []string{"calc", "json"} {
+		tag, ok := f.Tag.Lookup(key)
+		if !ok {
+			continue
+		}
+		if idx := strings.IndexByte(tag, ','); idx >= 0 {
+			tag = tag[:idx]
+		}
+		if tag != "" {
+			return tag, true
+		}
+	}
+	return f.Name, false
+}
+
+// field looks up a named field of struct value v using the cached plan.
+func field(v reflect.Value, name string) (interface{}, bool) {
+	f, find := fieldValue(v, name)
+	if !find {
+		return nil, false
+	}
+	return f.Interface(), true
+}
+
+func fieldValue(v reflect.Value, name string) (reflect.Value, bool) {
+	path, find := planFor(v.Type()).fields[name]
+	if !find {
+		return reflect.Value{}, false
+	}
+
+	for i, idx := range path {
+		if i > 0 {
+			if v.Kind() == reflect.Ptr {
+				if v.IsNil() {
+					return reflect.Value{}, false
+				}
+				v = v.Elem()
+			}
+		}
+		v = v.Field(idx)
+	}
+	return v, true
+}
+
+// ------------------------------------------------------------------
+
+// structResolver resolves variables from the fields of a Go struct.
+type structResolver struct {
+	v reflect.Value
+}
+
+func newStructResolver(v interface{}) (*structResolver, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("cannot bind nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot bind %T, struct expected", v)
+	}
+
+	return &structResolver{v: rv}, nil
+}
+
+func (s *structResolver) Resolve(name string) (interface{}, bool, error) {
+	val, find := field(s.v, name)
+	return val, find, nil
+}
+
+func (s *structResolver) Assign(name string, value interface{}) error {
+	return setField(s.v, name, value)
+}
+
+// ------------------------------------------------------------------
+
+// member returns the named member of a map or struct value.
+func member(obj interface{}, name string) (interface{}, bool) {
+	if m, ok := obj.(map[string]interface{}); ok {
+		val, find := m[name]
+		return val, find
+	}
+
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return field(v, name)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, false
+		}
+		val := v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		if !val.IsValid() {
+			return nil, false
+		}
+		return val.Interface(), true
+	}
+	return nil, false
+}
+
+// element returns the element of a slice, array or map value at index.
+// The index of a slice or an array counts from the end when negative.
+func element(obj interface{}, index *Result) (interface{}, error) {
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, errors.New("index of nil value")
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		i, err := elemIndex(index, v.Len())
+		if err != nil {
+			return nil, err
+		}
+		return v.Index(i).Interface(), nil
+	case reflect.Map:
+		key := reflect.ValueOf(index.data)
+		keyType := v.Type().Key()
+		if !key.IsValid() || !key.Type().ConvertibleTo(keyType) ||
+			keyType.Kind() != reflect.Interface && (keyType.Kind() == reflect.String) != (index.kind == String) {
+			return nil, fmt.Errorf("wrong index type[%v]", index.kind)
+		}
+		val := v.MapIndex(key.Convert(keyType))
+		if !val.IsValid() {
+			return nil, fmt.Errorf("key not found[%v]", index.data)
+		}
+		return val.Interface(), nil
+	case reflect.Struct:
+		if name, ok := index.data.(string); ok {
+			if val, find := field(v, name); find {
+				return val, nil
+			}
+			return nil, fmt.Errorf("field not found[%s]", name)
+		}
+	}
+	return nil, fmt.Errorf("cannot index %v", v.Kind())
+}
+
+// ------------------------------------------------------------------
+
+// setMember stores value into the named member of a map or struct value.
+// Structs must be reached through a pointer to be assignable.
+func setMember(obj interface{}, name string, value interface{}) error {
+	if m, ok := obj.(map[string]interface{}); ok {
+		m[name] = storeValue(m[name], value)
+		return nil
+	}
+
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return fmt.Errorf("cannot assign to member[%s] of nil value", name)
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return setField(v, name, value)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("cannot assign to member[%s] of %s", name, v.Type())
+		}
+		return setMapIndex(v, reflect.ValueOf(name), value)
+	}
+	return fmt.Errorf("cannot assign to member[%s] of %v", name, v.Kind())
+}
+
+// setElement stores value into the element of a slice, array or map value
+// at index. Arrays must be reached through a pointer to be assignable.
+func setElement(obj interface{}, index *Result, value interface{}) error {
+	v := reflect.ValueOf(obj)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return errors.New("index of nil value")
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		i, err := elemIndex(index, v.Len())
+		if err != nil {
+			return err
+		}
+		elem := v.Index(i)
+		if !elem.CanSet() {
+			return fmt.Errorf("cannot assign to element of unaddressable %v", v.Kind())
+		}
+		return setValue(elem, value)
+	case reflect.Map:
+		key := reflect.ValueOf(index.data)
+		keyType := v.Type().Key()
+		if !key.IsValid() || !key.Type().ConvertibleTo(keyType) ||
+			(keyType.Kind() == reflect.String) != (index.kind == String) {
+			return fmt.Errorf("wrong index type[%v]", index.kind)
+		}
+		return setMapIndex(v, key, value)
+	case reflect.Struct:
+		if name, ok := index.data.(string); ok {
+			return setField(v, name, value)
+		}
+	}
+	return fmt.Errorf("cannot index %v", v.Kind())
+}
+
+func setField(v reflect.Value, name string, value interface{}) error {
+	f, find := fieldValue(v, name)
+	if !find {
+		return fmt.Errorf("field not found[%s]", name)
+	}
+	if !f.CanSet() {
+		return fmt.Errorf("cannot assign to field[%s] of unaddressable struct", name)
+	}
+	return setValue(f, value)
+}
+
+func setMapIndex(m reflect.Value, key reflect.Value, value interface{}) error {
+	if m.IsNil() {
+		return errors.New("assignment to nil map")
+	}
+	key = key.Convert(m.Type().Key())
+	if m.Type().Elem().Kind() == reflect.Interface {
+		var old interface{}
+		if v := m.MapIndex(key); v.IsValid() {
+			old = v.Interface()
+		}
+		value = storeValue(old, value)
+	}
+	val, err := convertValue(value, m.Type().Elem())
+	if err != nil {
+		return err
+	}
+	m.SetMapIndex(key, val)
+	return nil
+}
+
+func setValue(dst reflect.Value, value interface{}) error {
+	if dst.Kind() == reflect.Interface {
+		var old interface{}
+		if !dst.IsNil() {
+			old = dst.Elem().Interface()
+		}
+		value = storeValue(old, value)
+	}
+	val, err := convertValue(value, dst.Type())
+	if err != nil {
+		return err
+	}
+	dst.Set(val)
+	return nil
+}
+
+// storeValue returns value as it is stored into an interface{} that holds
+// old: converted to the type of old where it converts, so that a float64
+// entry stays a float64, and with a Float widened to a float64 otherwise.
+func storeValue(old, value interface{}) interface{} {
+	if old != nil {
+		if v, err := convertValue(value, reflect.TypeOf(old)); err == nil {
+			return v.Interface()
+		}
+	}
+	if f, ok := value.(float32); ok {
+		return widen(f)
+	}
+	return value
+}
+
+// widen returns the float64 of the shortest decimal of f, so that the
+// Float 6.3 is stored as 6.3 rather than 6.299999713897705.
+func widen(f float32) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	return v
+}
+
+// convertValue converts a value computed by an expression to typ. Numbers
+// convert between numeric types as long as no integer overflows and no
+// float is truncated to an integer.
+func convertValue(value interface{}, typ reflect.Type) (reflect.Value, error) {
+	v := reflect.ValueOf(value)
+	if !v.IsValid() {
+		return reflect.Value{}, fmt.Errorf("cannot assign nil to %s", typ)
+	}
+	if v.Type().AssignableTo(typ) {
+		return v, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i, ok := value.(int); ok && !reflect.Zero(typ).OverflowInt(int64(i)) {
+			return v.Convert(typ), nil
+		}
+		if _, ok := value.(Rune); ok && typ.Kind() == reflect.Int32 {
+			return v.Convert(typ), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i, ok := value.(int); ok && i >= 0 && !reflect.Zero(typ).OverflowUint(uint64(i)) {
+			return v.Convert(typ), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch f := value.(type) {
+		case int:
+			return v.Convert(typ), nil
+		case float32:
+			return reflect.ValueOf(widen(f)).Convert(typ), nil
+		}
+	case reflect.String, reflect.Bool:
+		if v.Kind() == typ.Kind() {
+			return v.Convert(typ), nil
+		}
+	}
+	return reflect.Value{}, fmt.Errorf("cannot assign %T to %s", value, typ)
+}
+
+// ------------------------------------------------------------------
+
+// toResult converts a Go value into a Result. Scalars of named types are
+// converted by kind, composite values are kept as Object.
+func toResult(val interface{}) (*Result, error) {
+	switch v := val.(type) {
+	case int:
+		return &Result{kind: Integer, data: v}, nil
+	case int8:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case int16:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case int32:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case int64:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case uint:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case uint8:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case uint16:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case uint32:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case uint64:
+		return &Result{kind: Integer, data: int(v)}, nil
+	case float64:
+		return &Result{kind: Float, data: float32(v)}, nil
+	case float32:
+		return &Result{kind: Float, data: v}, nil
+	case string:
+		return &Result{kind: String, data: v}, nil
+	case bool:
+		return &Result{kind: Bool, data: v}, nil
+	case time.Time:
+		return &Result{kind: Time, data: v}, nil
+	case *time.Time:
+		if v != nil {
+			return &Result{kind: Time, data: *v}, nil
+		}
+	case time.Duration:
+		return &Result{kind: Duration, data: v}, nil
+	case complex128:
+		return &Result{kind: Complex, data: v}, nil
+	case complex64:
+		return &Result{kind: Complex, data: complex128(v)}, nil
+	case Measure:
+		return &Result{kind: Quantity, data: v}, nil
+	case Amount:
+		if v.Value != nil {
+			return &Result{kind: Money, data: v}, nil
+		}
+	case Rune:
+		return &Result{kind: Char, data: rune(v)}, nil
+	case nil:
+		return nil, errors.New("unsupported data type[nil]")
+	}
+
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Result{kind: Integer, data: int(rv.Int())}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Result{kind: Integer, data: int(rv.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Result{kind: Float, data: float32(rv.Float())}, nil
+	case reflect.Complex64, reflect.Complex128:
+		return &Result{kind: Complex, data: rv.Complex()}, nil
+	case reflect.String:
+		return &Result{kind: String, data: rv.String()}, nil
+	case reflect.Bool:
+		return &Result{kind: Bool, data: rv.Bool()}, nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, errors.New("unsupported data type[nil]")
+		}
+		if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Struct {
+			return &Result{kind: Object, data: val}, nil
+		}
+		return toResult(rv.Elem().Interface())
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return &Result{kind: Object, data: val}, nil
+	}
+	return nil, fmt.Errorf("unsupported data type[%T]", val)
+}
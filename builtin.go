@@ -0,0 +1,482 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"math/cmplx"
+	"reflect"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// builtin is a function predefined for expressions. It receives evaluated
+// arguments, lambdas among them as Func results.
+type builtin func(e *evaluator, args []*Result) (*Result, error)
+
+// builtins are the predefined functions. Most take a slice or array as
+// their first argument and a lambda as their second:
+//
+//	map(items, x => x.qty)                  the results of the lambda
+//	filter(items, x => x.price > 10)        the elements it accepts
+//	reduce(items, (acc, x) => acc + x, 0)   the folded value; init is optional
+//	any(items, f), all(items, f)            whether some or all elements match
+//	count(items, f)                         how many elements match
+//	find(items, f, default)                 the first match; default is optional
+//	sortBy(items, x => x.price)             the elements in stable key order
+//	groupBy(items, x => x.kind)             a map of key to elements
+//	sum(items), sum(items, x => x.price)    the sum of the elements or keys
+//	len(x)                                  the length of a collection or string
+//
+// and the time functions:
+//
+//	now()                                   the current time, see EvalOptions.Now
+//	parseTime(s, layout, zone)              a time; layout and zone are optional
+//	formatTime(t, layout, zone)             a string; layout and zone are optional
+//	parseDuration(s)                        a duration such as "1h30m"
+//	inZone(t, zone)                         the same time in another zone
+//
+// and the functions on quantities:
+//
+//	to(q, unit)                             q converted to unit, as in to(5 kg, "lb")
+//	quantity(x, unit)                       the number x in unit
+//
+// and the functions on money:
+//
+//	money(x, currency)                      the amount x, as in money("12.50", "EUR")
+//	round(m, mode)                          m rounded to the minor units of its currency
+//	to(m, currency)                         m converted, see EvalOptions.Rates
+//
+// and the functions on numbers, complex ones among them:
+//
+//	complex(re, im)                         the complex number re + im*1i
+//	real(c), imag(c)                        the real and the imaginary part
+//	abs(x)                                  the absolute value, or the modulus of c
+//	phase(c)                                the argument of c, in radians
+//	conj(c)                                 the complex conjugate
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"map":     builtinMap,
+		"filter":  builtinFilter,
+		"reduce":  builtinReduce,
+		"any":     builtinAny,
+		"all":     builtinAll,
+		"count":   builtinCount,
+		"find":    builtinFind,
+		"sortBy":  builtinSortBy,
+		"groupBy": builtinGroupBy,
+		"sum":     builtinSum,
+		"len":     builtinLen,
+
+		"now":           builtinNow,
+		"parseTime":     builtinParseTime,
+		"formatTime":    builtinFormatTime,
+		"parseDuration": builtinParseDuration,
+		"inZone":        builtinInZone,
+
+		"to":       builtinTo,
+		"quantity": builtinQuantity,
+
+		"money": builtinMoney,
+		"round": builtinRound,
+
+		"complex": builtinComplex,
+		"real":    complexFunc("real", func(c complex128) *Result { return floatResult(real(c)) }),
+		"imag":    complexFunc("imag", func(c complex128) *Result { return floatResult(imag(c)) }),
+		"abs":     builtinAbs,
+		"phase":   complexFunc("phase", func(c complex128) *Result { return floatResult(cmplx.Phase(c)) }),
+		"conj":    complexFunc("conj", func(c complex128) *Result { return complexResult(cmplx.Conj(c)) }),
+	}
+}
+
+func builtinMap(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("map", args, 2, 2); err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		result, err := e.call(args[1], elem)
+		if err != nil {
+			return false, err
+		}
+		out = append(out, goValue(result))
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.value(ensureSlice(out))
+}
+
+func builtinFilter(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("filter", args, 2, 2); err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	err := e.each(args[0], func(raw interface{}, elem *Result) (bool, error) {
+		ok, err := e.test(args[1], elem)
+		if ok {
+			out = append(out, raw)
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.value(ensureSlice(out))
+}
+
+func builtinReduce(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("reduce", args, 2, 3); err != nil {
+		return nil, err
+	}
+	var acc *Result
+	if len(args) == 3 {
+		acc = args[2]
+	}
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		if acc == nil {
+			acc = elem
+			return true, nil
+		}
+		var err error
+		acc, err = e.call(args[1], acc, elem)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if acc == nil {
+		return nil, errors.New("reduce of empty collection with no initial value")
+	}
+	return acc, nil
+}
+
+func builtinAny(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("any", args, 2, 2); err != nil {
+		return nil, err
+	}
+	found := false
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		ok, err := e.test(args[1], elem)
+		found = ok
+		return !ok && err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{kind: Bool, data: found}, nil
+}
+
+func builtinAll(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("all", args, 2, 2); err != nil {
+		return nil, err
+	}
+	all := true
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		ok, err := e.test(args[1], elem)
+		all = ok
+		return ok && err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{kind: Bool, data: all}, nil
+}
+
+func builtinCount(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("count", args, 2, 2); err != nil {
+		return nil, err
+	}
+	n := 0
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		ok, err := e.test(args[1], elem)
+		if ok {
+			n++
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Result{kind: Integer, data: n}, nil
+}
+
+func builtinFind(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("find", args, 2, 3); err != nil {
+		return nil, err
+	}
+	var found *Result
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		ok, err := e.test(args[1], elem)
+		if ok {
+			found = elem
+		}
+		return !ok && err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		if len(args) == 3 {
+			return args[2], nil
+		}
+		return nil, errors.New("find: no element matches")
+	}
+	return found, nil
+}
+
+func builtinSortBy(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("sortBy", args, 2, 2); err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	var keys []*Result
+	err := e.each(args[0], func(raw interface{}, elem *Result) (bool, error) {
+		key, err := e.call(args[1], elem)
+		if err != nil {
+			return false, err
+		}
+		out = append(out, raw)
+		keys = append(keys, key)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// sort the indexes, so that keys and elements move together
+	order := make([]int, len(out))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		c, cerr := e.compare(keys[order[i]], keys[order[j]])
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+		return c < 0
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]interface{}, len(out))
+	for i, idx := range order {
+		sorted[i] = out[idx]
+	}
+	return e.value(sorted)
+}
+
+// builtinGroupBy groups the elements by key. Keys of different kinds are
+// different, so 1 and "1" make two groups; the map is keyed by strings when
+// all the keys are strings, and by the key values otherwise.
+func builtinGroupBy(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("groupBy", args, 2, 2); err != nil {
+		return nil, err
+	}
+	groups := make(map[interface{}]interface{})
+	strs := true
+	err := e.each(args[0], func(raw interface{}, elem *Result) (bool, error) {
+		key, err := e.call(args[1], elem)
+		if err != nil {
+			return false, err
+		}
+		switch key.kind {
+		case String, Integer, Float, Bool:
+		default:
+			return false, fmt.Errorf("groupBy: wrong key type[%v]", key.kind)
+		}
+		strs = strs && key.kind == String
+		group, _ := groups[key.data].([]interface{})
+		groups[key.data] = append(group, raw)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !strs {
+		return e.value(groups)
+	}
+	byName := make(map[string]interface{}, len(groups))
+	for k, group := range groups {
+		byName[k.(string)] = group
+	}
+	return e.value(byName)
+}
+
+func builtinSum(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("sum", args, 1, 2); err != nil {
+		return nil, err
+	}
+	var total *Result
+	err := e.each(args[0], func(_ interface{}, elem *Result) (bool, error) {
+		var err error
+		if len(args) == 2 {
+			if elem, err = e.call(args[1], elem); err != nil {
+				return false, err
+			}
+		}
+		if total == nil {
+			total = elem // so that durations and quantities add up too
+			return true, nil
+		}
+		total, err = e.binary(OpAdd, total, elem)
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if total == nil {
+		return &Result{kind: Integer, data: 0}, nil
+	}
+	return total, nil
+}
+
+func builtinLen(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("len", args, 1, 1); err != nil {
+		return nil, err
+	}
+	if s, ok := args[0].data.(string); ok && args[0].kind == String {
+		return &Result{kind: Integer, data: utf8.RuneCountInString(s)}, nil
+	}
+
+	v := reflect.ValueOf(args[0].data)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return &Result{kind: Integer, data: v.Len()}, nil
+	}
+	return nil, fmt.Errorf("len: wrong argument type[%v]", args[0].kind)
+}
+
+// ------------------------------------------------------------------
+
+func checkArgs(name string, args []*Result, min, max int) error {
+	if len(args) < min || len(args) > max {
+		want := fmt.Sprint(min)
+		if max > min {
+			want = fmt.Sprintf("%d to %d", min, max)
+		}
+		return fmt.Errorf("%s: wrong argument count[%d], want %s", name, len(args), want)
+	}
+	return nil
+}
+
+// each calls f with the elements of the slice or array coll, as Go values
+// and as Results, until f returns false or an error.
+func (e *evaluator) each(coll *Result, f func(raw interface{}, elem *Result) (bool, error)) error {
+	v := reflect.ValueOf(coll.data)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	if coll.kind != Object || (v.Kind() != reflect.Slice && v.Kind() != reflect.Array) {
+		return fmt.Errorf("wrong collection type[%v]", coll.kind)
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		raw := v.Index(i).Interface()
+		elem, err := e.value(raw)
+		if err != nil {
+			return err
+		}
+		if more, err := f(raw, elem); err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// test calls the predicate fn with elem.
+func (e *evaluator) test(fn *Result, elem *Result) (bool, error) {
+	result, err := e.call(fn, elem)
+	if err != nil {
+		return false, err
+	}
+	ok, isBool := result.data.(bool)
+	if !isBool {
+		return false, fmt.Errorf("predicate returns %v, want %v", result.kind, Bool)
+	}
+	return ok, nil
+}
+
+// compare orders two numbers, strings, times, durations or quantities.
+func (e *evaluator) compare(a, b *Result) (int, error) {
+	if a.kind == Quantity && b.kind == Quantity {
+		return compareQuantity(a, b)
+	}
+	if x, ok := a.data.(Amount); ok {
+		if y, ok := b.data.(Amount); ok && x.Currency == y.Currency {
+			return x.Value.Cmp(y.Value), nil
+		}
+	}
+	switch x := a.data.(type) {
+	case int:
+		switch y := b.data.(type) {
+		case int:
+			return compareInt(x, y), nil
+		case float32:
+			return compareFloat(float64(x), float64(y)), nil
+		}
+	case float32:
+		switch y := b.data.(type) {
+		case int:
+			return compareFloat(float64(x), float64(y)), nil
+		case float32:
+			return compareFloat(float64(x), float64(y)), nil
+		}
+	case string:
+		if y, ok := b.data.(string); ok {
+			return e.compareText(x, y), nil
+		}
+	case rune:
+		if y, ok := b.data.(rune); ok {
+			return e.compareText(string(x), string(y)), nil
+		}
+	case time.Time:
+		if y, ok := b.data.(time.Time); ok {
+			return compareTime(x, y), nil
+		}
+	case time.Duration:
+		if y, ok := b.data.(time.Duration); ok {
+			return compareInt(int(x), int(y)), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %v and %v", a.kind, b.kind)
+}
+
+func compareInt(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// ensureSlice keeps the result of an empty collection a slice, rather than
+// a nil value.
+func ensureSlice(s []interface{}) []interface{} {
+	if s == nil {
+		return []interface{}{}
+	}
+	return s
+}
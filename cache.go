@@ -0,0 +1,139 @@
+package gocalc
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a size-bounded LRU cache of compiled expressions keyed by their
+// source text and parse options. It is safe for concurrent use, and the
+// expressions it returns are shared: callers must treat them as immutable.
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List // front is most recently used
+	items map[cacheKey]*list.Element
+	stats CacheStats
+
+	now func() time.Time
+}
+
+// CacheStats reports the activity of a Cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+}
+
+type cacheKey struct {
+	src  string
+	opts ParseOptions
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	expr    *Expression
+	expires time.Time
+}
+
+// NewCache returns a cache holding at most size expressions. If ttl is
+// positive, an expression is recompiled once it has been cached for ttl.
+func NewCache(size int, ttl time.Duration) *Cache {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[cacheKey]*list.Element, size),
+		now:   time.Now,
+	}
+}
+
+// Get returns the compiled expression for src, compiling and caching it on
+// a miss. Sources that fail to compile are not cached.
+func (c *Cache) Get(src string) (*Expression, error) {
+	return c.GetWithOptions(src, DefaultParseOptions)
+}
+
+// GetWithOptions is like Get but compiles with the limits of opts.
+func (c *Cache) GetWithOptions(src string, opts ParseOptions) (*Expression, error) {
+	key := cacheKey{src: src, opts: opts}
+	if expr, ok := c.lookup(key); ok {
+		return expr, nil
+	}
+
+	expr, err := CompileWithOptions(src, opts)
+	if err != nil {
+		return nil, err
+	}
+	return c.add(key, expr), nil
+}
+
+func (c *Cache) lookup(key cacheKey) (*Expression, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, find := c.items[key]; find {
+		entry := elem.Value.(*cacheEntry)
+		if c.ttl <= 0 || c.now().Before(entry.expires) {
+			c.ll.MoveToFront(elem)
+			c.stats.Hits++
+			return entry.expr, true
+		}
+		c.remove(elem)
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// add caches expr, unless another goroutine compiled the same key in the
+// meantime, in which case the expression already cached is returned.
+func (c *Cache) add(key cacheKey, expr *Expression) *Expression {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, find := c.items[key]; find {
+		c.ll.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).expr
+	}
+
+	entry := &cacheEntry{key: key, expr: expr}
+	if c.ttl > 0 {
+		entry.expires = c.now().Add(c.ttl)
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+		c.stats.Evictions++
+	}
+	return expr
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	c.ll.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.ll.Len()
+	return stats
+}
+
+// Purge removes every cached expression.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[cacheKey]*list.Element, c.size)
+}
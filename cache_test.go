@@ -0,0 +1,72 @@
+package gocalc
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache(2, 0)
+
+	a, err := c.Get(`a + 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := c.Get(`a + 1`); again != a {
+		t.Errorf("expected the cached expression to be shared")
+	}
+	c.Get(`b + 1`)
+	c.Get(`c + 1`) // evicts a + 1
+	if again, _ := c.Get(`a + 1`); again == a {
+		t.Errorf("expected a + 1 to be evicted")
+	}
+	if _, err := c.Get(`a +`); err == nil {
+		t.Errorf("expected a syntax error")
+	}
+
+	want := CacheStats{Hits: 1, Misses: 5, Evictions: 2, Size: 2}
+	if stats := c.Stats(); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := NewCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	a, _ := c.Get(`a`)
+	now = now.Add(30 * time.Second)
+	if again, _ := c.Get(`a`); again != a {
+		t.Errorf("expected a cache hit before the ttl")
+	}
+	now = now.Add(time.Minute)
+	if again, _ := c.Get(`a`); again == a {
+		t.Errorf("expected the entry to expire")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(4, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				expr, err := c.Get(`x * 2`)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				result := expr.Calc(map[string]interface{}{"x": i})
+				if v, _ := result.Int(); v != i*2 {
+					t.Errorf("got %d, want %d", v, i*2)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -1,12 +1,18 @@
 package gocalc
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/big"
+	"time"
 )
 
 type Expression struct {
-	Expr   Expr
+	Expr Expr
+
+	// Deprecated: Params is not read nor written by the evaluation; pass
+	// the variables to Calc, CalcWith or EvalContext instead.
 	Params map[string]interface{}
 }
 
@@ -17,17 +23,47 @@ func NewExpression(expression string) *Expression {
 	}
 }
 
+// Compile parses an expression, reporting syntax errors. The returned
+// Expression does not change when evaluated and may be shared between
+// goroutines.
+func Compile(expression string) (*Expression, error) {
+	return CompileWithOptions(expression, DefaultParseOptions)
+}
+
+// CompileWithOptions is like Compile but parses with the limits of opts.
+func CompileWithOptions(expression string, opts ParseOptions) (*Expression, error) {
+	expr, err := ParseWithOptions(expression, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Expression{
+		Expr: expr,
+	}, nil
+}
+
 func (e *Expression) Calc(params map[string]interface{}) *Result {
-	e.Params = params
-	if e.Params == nil {
-		e.Params = make(map[string]interface{}, 2)
+	return e.calc(MapResolver(params))
+}
+
+// CalcWith evaluates the expression with v as the root scope. v may be a
+// Resolver, a params map or a struct (or pointer to struct) whose exported
+// fields are bound by their `calc` or `json` tag names, falling back to the
+// field name.
+func (e *Expression) CalcWith(v interface{}) *Result {
+	resolver, err := newResolver(v)
+	if err != nil {
+		fmt.Println(err)
+		return nil
 	}
 
-	return e.calc()
+	return e.calc(resolver)
 }
 
-func (e *Expression) calc() *Result {
-	result, err := e.calcExpr(e.Expr)
+func (e *Expression) calc(resolver Resolver) *Result {
+	ev := &evaluator{
+		resolver: resolver,
+	}
+	result, err := ev.calcExpr(e.Expr)
 	if err != nil {
 		fmt.Println(err)
 		return nil
@@ -36,110 +72,329 @@ func (e *Expression) calc() *Result {
 	return result
 }
 
-func (e *Expression) calcExpr(expr Expr) (*Result, error) {
+// --------------------------------------------------------------------------
+
+// evaluator holds the state of a single evaluation.
+type evaluator struct {
+	ctx      context.Context
+	resolver Resolver
+	scope    *scope
+	opts     EvalOptions
+	steps    int
+	depth    int
+	calls    int // lambda calls in progress
+}
+
+// maxCalls bounds the nesting of lambda calls, which recursion through a
+// let binding could otherwise grow until the stack overflows.
+const maxCalls = 1000
+
+// scope holds the variables bound during evaluation, such as let bindings,
+// which hide the variables of the resolver.
+type scope struct {
+	vars   map[string]*Result
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (*Result, bool) {
+	for ; s != nil; s = s.parent {
+		if result, find := s.vars[name]; find {
+			return result, true
+		}
+	}
+	return nil, false
+}
+
+// closure is the value of a lambda: the lambda and the scope it was
+// created in.
+type closure struct {
+	lambda *LambdaExpr
+	scope  *scope
+}
+
+func (e *evaluator) calcExpr(expr Expr) (result *Result, err error) {
+	if err := e.enter(); err != nil {
+		return nil, errorAt(expr, err)
+	}
+	defer e.leave()
+
 	switch ex := expr.(type) {
 	case *LiteralExpr:
-		return e.calcLiteralExpr(ex)
+		result, err = e.calcLiteralExpr(ex)
 	case *IdentExpr:
-		return e.calcIdentExpr(ex)
+		result, err = e.calcIdentExpr(ex)
 	case *UnaryExpr:
-		return e.calcUnaryExpr(ex)
+		result, err = e.calcUnaryExpr(ex)
 	case *BinaryExpr:
-		return e.calcBinaryExpr(ex)
+		result, err = e.calcBinaryExpr(ex)
 	case *ParenExpr:
-		return e.calcParenExpr(ex)
+		result, err = e.calcParenExpr(ex)
+	case *AccessExpr:
+		result, err = e.calcAccessExpr(ex)
+	case *IndexExpr:
+		result, err = e.calcIndexExpr(ex)
+	case *SliceExpr:
+		result, err = e.calcSliceExpr(ex)
+	case *LetExpr:
+		result, err = e.calcLetExpr(ex)
+	case *AssignExpr:
+		result, err = e.calcAssignExpr(ex)
+	case *LambdaExpr:
+		result, err = e.calcLambdaExpr(ex)
+	case *CallExpr:
+		result, err = e.calcCallExpr(ex)
+	case *UnitExpr:
+		result, err = e.calcUnitExpr(ex)
+	case *Program:
+		result, err = e.calcProgram(ex)
 	default:
 		return nil, fmt.Errorf("unknown express type[%s]", ex)
 	}
+
+	if err != nil {
+		return nil, errorAt(expr, err)
+	}
+	return result, nil
 }
 
-func (e *Expression) calcIdentExpr(expr *IdentExpr) (*Result, error) {
-	if val, find := e.Params[expr.Name]; find {
-		switch v := val.(type) {
-		case int:
-			result := &Result{
-				kind: Integer,
-				data: v,
-			}
-			return result, nil
-		case int8:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case int16:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case int32:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case uint:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case uint8:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case uint16:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case uint32:
-			result := &Result{
-				kind: Integer,
-				data: int(v),
-			}
-			return result, nil
-		case float64:
-			result := &Result{
-				kind: Float,
-				data: float32(v),
-			}
-			return result, nil
-		case float32:
-			result := &Result{
-				kind: Float,
-				data: v,
-			}
-			return result, nil
-		case string:
-			result := &Result{
-				kind: String,
-				data: v,
-			}
-			return result, nil
-		case bool:
-			result := &Result{
-				kind: Bool,
-				data: v,
+func (e *evaluator) calcIdentExpr(expr *IdentExpr) (*Result, error) {
+	if result, find := e.scope.lookup(expr.Name); find {
+		return result, nil
+	}
+	val, find, err := e.resolver.Resolve(expr.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !find {
+		return nil, fmt.Errorf("undefined variable[%s]", expr.Name)
+	}
+	return e.value(val)
+}
+
+// calcProgram evaluates the statements in a new scope and returns the
+// value of the last one.
+func (e *evaluator) calcProgram(expr *Program) (*Result, error) {
+	if len(expr.Stmts) == 0 {
+		return nil, errors.New("empty program")
+	}
+
+	parent := e.scope
+	e.scope = &scope{vars: make(map[string]*Result), parent: parent}
+	defer func() { e.scope = parent }()
+
+	var result *Result
+	for _, stmt := range expr.Stmts {
+		var err error
+		if result, err = e.calcExpr(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (e *evaluator) calcLetExpr(expr *LetExpr) (*Result, error) {
+	if e.scope == nil {
+		return nil, fmt.Errorf("let outside of a program[%s]", expr.Name.Name)
+	}
+	result, err := e.calcExpr(expr.Value)
+	if err != nil {
+		return nil, err
+	}
+	e.scope.vars[expr.Name.Name] = result
+	return result, nil
+}
+
+func (e *evaluator) calcAssignExpr(expr *AssignExpr) (*Result, error) {
+	result, err := e.calcExpr(expr.Value)
+	if err != nil {
+		return nil, err
+	}
+	if expr.Op != OpAssign {
+		old, err := e.calcExpr(expr.Target)
+		if err != nil {
+			return nil, err
+		}
+		op := OpAdd
+		if expr.Op == OpMinusAssign {
+			op = OpMinus
+		}
+		if result, err = e.binary(op, old, result); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.assign(expr.Target, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// assign stores result into the variable, member or element target.
+func (e *evaluator) assign(target Expr, result *Result) error {
+	switch t := target.(type) {
+	case *IdentExpr:
+		for s := e.scope; s != nil; s = s.parent {
+			if _, find := s.vars[t.Name]; find {
+				s.vars[t.Name] = result
+				return nil
 			}
-			return result, nil
-			//case func():
+		}
+		assigner, ok := e.resolver.(Assigner)
+		if !ok {
+			return fmt.Errorf("cannot assign to variable[%s]", t.Name)
+		}
+		return assigner.Assign(t.Name, goValue(result))
+	case *AccessExpr:
+		obj, err := e.calcExpr(t.E)
+		if err != nil {
+			return err
+		}
+		return setMember(obj.data, t.Access.Name, goValue(result))
+	case *IndexExpr:
+		obj, err := e.calcExpr(t.E)
+		if err != nil {
+			return err
+		}
+		index, err := e.calcExpr(t.Index)
+		if err != nil {
+			return err
+		}
+		return setElement(obj.data, index, goValue(result))
+	}
+	return fmt.Errorf("cannot assign to %s", Format(target))
+}
+
+func (e *evaluator) calcLambdaExpr(expr *LambdaExpr) (*Result, error) {
+	result := &Result{
+		kind: Func,
+		data: &closure{lambda: expr, scope: e.scope},
+	}
+	return result, nil
+}
+
+// calcCallExpr calls a built-in function, unless its name is hidden by a
+// variable of the script, or the lambda value of the callee.
+func (e *evaluator) calcCallExpr(expr *CallExpr) (*Result, error) {
+	if fun, ok := expr.Fun.(*AccessExpr); ok {
+		return e.calcMethodCall(fun, expr.Args)
+	}
+
+	var fn builtin
+	var name string
+	if id, ok := expr.Fun.(*IdentExpr); ok {
+		if _, local := e.scope.lookup(id.Name); !local {
+			fn, name = builtins[id.Name], id.Name
+		}
+	}
+
+	var fun *Result
+	if fn == nil {
+		var err error
+		if fun, err = e.calcExpr(expr.Fun); err != nil {
+			return nil, err
+		}
+	}
 
+	args := make([]*Result, len(expr.Args))
+	for i, arg := range expr.Args {
+		var err error
+		if i == 0 && fn != nil && name == "money" {
+			args[i], err = e.calcAmount(arg)
+		} else {
+			args[i], err = e.calcExpr(arg)
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if fn != nil {
+		return fn(e, args)
 	}
-	return nil, errors.New("unsupported data type")
+	return e.call(fun, args...)
 }
 
-func (e *Expression) calcParenExpr(expr *ParenExpr) (*Result, error) {
+// call calls the lambda value fun with args bound to its parameters.
+func (e *evaluator) call(fun *Result, args ...*Result) (*Result, error) {
+	c, ok := fun.data.(*closure)
+	if fun.kind != Func || !ok {
+		return nil, fmt.Errorf("cannot call %v", fun.kind)
+	}
+	if len(args) != len(c.lambda.Params) {
+		return nil, fmt.Errorf("wrong argument count[%d], want %d", len(args), len(c.lambda.Params))
+	}
+
+	s := &scope{vars: make(map[string]*Result, len(args)), parent: c.scope}
+	for i, param := range c.lambda.Params {
+		s.vars[param.Name] = args[i]
+	}
+	if e.calls >= maxCalls {
+		return nil, fmt.Errorf("lambda calls nested deeper than %d", maxCalls)
+	}
+	parent := e.scope
+	e.scope = s
+	e.calls++
+	defer func() { e.scope, e.calls = parent, e.calls-1 }()
+
+	return e.calcExpr(c.lambda.Body)
+}
+
+// value converts a Go value read during evaluation into a Result.
+func (e *evaluator) value(val interface{}) (*Result, error) {
+	result, err := toResult(val)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.checkCollection(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (e *evaluator) calcAccessExpr(expr *AccessExpr) (*Result, error) {
+	obj, err := e.calcExpr(expr.E)
+	if err != nil {
+		return nil, err
+	}
+	if obj.kind != Object {
+		return nil, fmt.Errorf("wrong access expression[%v.%s]", obj.kind, expr.Access.Name)
+	}
+
+	val, find := member(obj.data, expr.Access.Name)
+	if !find {
+		return nil, fmt.Errorf("undefined member[%s]", expr.Access.Name)
+	}
+	return e.value(val)
+}
+
+func (e *evaluator) calcIndexExpr(expr *IndexExpr) (*Result, error) {
+	obj, err := e.calcExpr(expr.E)
+	if err != nil {
+		return nil, err
+	}
+	index, err := e.calcExpr(expr.Index)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := obj.data.(string); ok && obj.kind == String {
+		return charAt(s, index)
+	}
+	if obj.kind != Object {
+		return nil, fmt.Errorf("wrong index expression[%v[%v]]", obj.kind, index.kind)
+	}
+
+	val, err := element(obj.data, index)
+	if err != nil {
+		return nil, err
+	}
+	return e.value(val)
+}
+
+func (e *evaluator) calcParenExpr(expr *ParenExpr) (*Result, error) {
 	return e.calcExpr(expr.E)
 }
 
-func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
+func (e *evaluator) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 	l, err := e.calcExpr(expr.LE)
 	if err != nil {
 		return nil, err
@@ -148,8 +403,27 @@ func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 	if err != nil {
 		return nil, err
 	}
+	return e.binary(expr.Op, l, r)
+}
 
-	switch expr.Op {
+// binary applies the binary operator op to its evaluated operands.
+func (e *evaluator) binary(op Token, l, r *Result) (*Result, error) {
+	if l.kind == Time || l.kind == Duration || r.kind == Time || r.kind == Duration {
+		return timeBinary(op, l, r)
+	}
+	if l.kind == Quantity || r.kind == Quantity {
+		return quantityBinary(op, l, r)
+	}
+	if l.kind == Money || r.kind == Money {
+		return e.moneyBinary(op, l, r)
+	}
+	if l.kind == Complex || r.kind == Complex {
+		return complexBinary(op, l, r)
+	}
+	if l.kind == String || l.kind == Char || r.kind == String || r.kind == Char {
+		return e.textBinary(op, l, r)
+	}
+	switch op {
 	case OpAdd:
 		if l.kind == Integer {
 			if r.kind == Integer {
@@ -183,13 +457,6 @@ func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 				}
 				return result, nil
 			}
-		} else if l.kind == String && r.kind == String {
-			data := l.data.(string) + r.data.(string)
-			result := &Result{
-				kind: String,
-				data: data,
-			}
-			return result, nil
 		}
 	case OpMinus:
 		if l.kind == Integer {
@@ -262,6 +529,9 @@ func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 	case OpDivide:
 		if l.kind == Integer {
 			if r.kind == Integer {
+				if r.data.(int) == 0 {
+					return nil, errors.New("integer divide by zero")
+				}
 				data := l.data.(int) / r.data.(int)
 				result := &Result{
 					kind: Integer,
@@ -295,6 +565,9 @@ func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 		}
 	case OpModulus:
 		if l.kind == Integer && r.kind == Integer {
+			if r.data.(int) == 0 {
+				return nil, errors.New("integer divide by zero")
+			}
 			data := l.data.(int) % r.data.(int)
 			result := &Result{
 				kind: Integer,
@@ -538,20 +811,25 @@ func (e *Expression) calcBinaryExpr(expr *BinaryExpr) (*Result, error) {
 			}
 			return result, nil
 		}
+	case OpPower:
+		return power(l, r)
 	}
 
-	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, expr.Op, r.kind)
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
 }
 
-func (e *Expression) calcLiteralExpr(expr *LiteralExpr) (*Result, error) {
+func (e *evaluator) calcLiteralExpr(expr *LiteralExpr) (*Result, error) {
 	result := &Result{
 		kind: expr.Kind,
 		data: expr.Date,
 	}
+	if v, ok := expr.Date.(float64); ok {
+		result.data = float32(v)
+	}
 	return result, nil
 }
 
-func (e *Expression) calcUnaryExpr(expr *UnaryExpr) (*Result, error) {
+func (e *evaluator) calcUnaryExpr(expr *UnaryExpr) (*Result, error) {
 	result, err := e.calcExpr(expr.E)
 	if err != nil {
 		return nil, err
@@ -591,6 +869,36 @@ func (e *Expression) calcUnaryExpr(expr *UnaryExpr) (*Result, error) {
 				data: data,
 			}
 			return res, nil
+		case Duration:
+			data := -(result.data.(time.Duration))
+			res := &Result{
+				kind: result.kind,
+				data: data,
+			}
+			return res, nil
+		case Quantity:
+			data := result.data.(Measure)
+			data.Value = -data.Value
+			res := &Result{
+				kind: result.kind,
+				data: data,
+			}
+			return res, nil
+		case Money:
+			data := result.data.(Amount)
+			data.Value = new(big.Rat).Neg(data.Value)
+			res := &Result{
+				kind: result.kind,
+				data: data,
+			}
+			return res, nil
+		case Complex:
+			data := -(result.data.(complex128))
+			res := &Result{
+				kind: result.kind,
+				data: data,
+			}
+			return res, nil
 		}
 
 	case OpNot:
@@ -618,6 +926,16 @@ type Result struct {
 	data interface{}
 }
 
+// Kind returns the kind of the value, such as Integer, Float or Object.
+func (r Result) Kind() Token {
+	return r.kind
+}
+
+// Value returns the value as a Go value.
+func (r Result) Value() interface{} {
+	return r.data
+}
+
 func (r Result) Int() (int, error) {
 	if v, ok := r.data.(int); ok {
 		return v, nil
@@ -646,8 +964,46 @@ func (r Result) String() (string, error) {
 	return "", fmt.Errorf("conversion error, %v is not string", r.data)
 }
 
+func (r Result) Time() (time.Time, error) {
+	if v, ok := r.data.(time.Time); ok {
+		return v, nil
+	}
+	return time.Time{}, fmt.Errorf("conversion error, %v is not time", r.data)
+}
+
+func (r Result) Duration() (time.Duration, error) {
+	if v, ok := r.data.(time.Duration); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("conversion error, %v is not duration", r.data)
+}
+
+func (r Result) Measure() (Measure, error) {
+	if v, ok := r.data.(Measure); ok {
+		return v, nil
+	}
+	return Measure{}, fmt.Errorf("conversion error, %v is not quantity", r.data)
+}
+
+func (r Result) Complex() (complex128, error) {
+	if v, ok := r.data.(complex128); ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("conversion error, %v is not complex", r.data)
+}
+
+func (r Result) Amount() (Amount, error) {
+	if v, ok := r.data.(Amount); ok {
+		return v, nil
+	}
+	return Amount{}, fmt.Errorf("conversion error, %v is not money", r.data)
+}
+
 func (r Result) Char() (rune, error) {
-	if v, ok := r.data.(int); ok {
+	switch v := r.data.(type) {
+	case rune:
+		return v, nil
+	case int:
 		return rune(v), nil
 	}
 	return 0, fmt.Errorf("conversion error, %v is not char", r.data)
@@ -0,0 +1,986 @@
+package gocalc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAddress struct {
+	City string `json:"city"`
+}
+
+func (a testAddress) Label(prefix string) string {
+	return prefix + a.City
+}
+
+func (a *testAddress) Move(city string) (string, error) {
+	if city == "" {
+		return "", errors.New("no city")
+	}
+	a.City = city
+	return city, nil
+}
+
+type testBase struct {
+	ID int `calc:"id"`
+}
+
+type testUser struct {
+	testBase
+	Name    string       `json:"name"`
+	Age     int          `calc:"age" json:"years"`
+	Score   float64      `json:"score,omitempty"`
+	Address *testAddress `json:"address"`
+	Tags    []string     `json:"tags"`
+	Secret  string       `json:"-"`
+}
+
+func TestCalcWithStruct(t *testing.T) {
+	user := &testUser{
+		testBase: testBase{ID: 7},
+		Name:     "ann",
+		Age:      30,
+		Score:    1.5,
+		Address:  &testAddress{City: "paris"},
+		Tags:     []string{"a", "b"},
+	}
+
+	cases := []struct {
+		expr string
+		want interface{}
+	}{
+		{`age + id`, 37},
+		{`score * 2`, float32(3)},
+		{`name + "!"`, "ann!"},
+		{`address.city`, "paris"},
+		{`tags[1]`, "b"},
+		{`age >= 18 && id < 10`, true},
+	}
+	for _, c := range cases {
+		result := NewExpression(c.expr).CalcWith(user)
+		if result == nil {
+			t.Errorf("%s: unexpected error", c.expr)
+			continue
+		}
+		if result.data != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, result.data, c.want)
+		}
+	}
+
+	for _, expr := range []string{`Age`, `years`, `Secret`} {
+		if result := NewExpression(expr).CalcWith(user); result != nil {
+			t.Errorf("%s: expected unbound name, got %v", expr, result.data)
+		}
+	}
+}
+
+func TestCalcWithMap(t *testing.T) {
+	params := map[string]interface{}{
+		"order": map[string]interface{}{"qty": 3, "price": 2.5},
+	}
+	result := NewExpression(`order.qty * order.price`).CalcWith(params)
+	if result == nil {
+		t.Fatal("unexpected error")
+	}
+	if v, err := result.Float(); err != nil || v != 7.5 {
+		t.Errorf("got %v %v, want 7.5", v, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	params := map[string]interface{}{"price": 30, "qty": 4, "x": 1}
+
+	cases := []struct {
+		expr string
+		want interface{}
+	}{
+		{`let total = price * qty; total > 100 && total < 1000`, true},
+		{`let x = x + 1; let x = x * 10; x`, 20},
+		{`let a = 2; let b = a * a; b + a;`, 6},
+		{`let y = "s"`, "s"},
+	}
+	for _, c := range cases {
+		result := NewExpression(c.expr).Calc(params)
+		if result == nil {
+			t.Errorf("%s: unexpected error", c.expr)
+			continue
+		}
+		if result.data != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, result.data, c.want)
+		}
+	}
+
+	deps := NewExpression(`let t = price * qty; t + tax`).Variables()
+	if want := []string{"price", "qty", "tax"}; !reflect.DeepEqual(deps.Names, want) {
+		t.Errorf("got %v, want %v", deps.Names, want)
+	}
+
+	for _, src := range []string{`let = 1`, `let x 1`, `let x = ;`, `a; let`, `;`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected a syntax error", src)
+		}
+	}
+}
+
+func TestLambda(t *testing.T) {
+	params := map[string]interface{}{
+		"nums": []int{3, 1, 2},
+		"items": []map[string]interface{}{
+			{"name": "pen", "kind": "office", "price": 2},
+			{"name": "ink", "kind": "office", "price": 12},
+			{"name": "tea", "kind": "food", "price": 5},
+		},
+		"s":     "héllo",
+		"mixed": []interface{}{1, "1", 1, true},
+	}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`filter(nums, x => x > 1)`, `[3 2]`},
+		{`map(nums, x -> x * 10)`, `[30 10 20]`},
+		{`sum(nums)`, `6`},
+		{`sum(items, x => x.price)`, `19`},
+		{`reduce(nums, (acc, x) => acc * x)`, `6`},
+		{`reduce(nums, (acc, x) => acc + x, 100)`, `106`},
+		{`any(items, x => x.price > 10)`, `true`},
+		{`all(items, x => x.price > 10)`, `false`},
+		{`count(items, x => x.price < 10)`, `2`},
+		{`find(items, x => x.price > 3).name`, `ink`},
+		{`find(nums, x => x > 5, -1)`, `-1`},
+		{`map(sortBy(items, x => x.price), x => x.name)`, `[pen tea ink]`},
+		{`len(groupBy(items, x => x.kind).office)`, `2`},
+		{`len(groupBy(mixed, x => x))`, `3`},
+		{`len(groupBy(mixed, x => x)[1]) * 10 + len(groupBy(mixed, x => x)["1"])`, `21`},
+		{`len(s) + len(nums)`, `8`},
+		{`let limit = 2; count(nums, x => x > limit)`, `1`},
+		{`let add = (a, b) => a + b; add(1, 2)`, `3`},
+		{`let twice = f => x => f(f(x)); twice(x => x * 3)(2)`, `18`},
+		{`let len = x => 0; len(nums)`, `0`},
+		{`sum(filter(map(nums, x => x * 2), x => x != 2))`, `10`},
+	}
+	for _, c := range cases {
+		result := NewExpression(c.expr).Calc(params)
+		if result == nil {
+			t.Errorf("%s: unexpected error", c.expr)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		`map(nums)`,
+		`(x => x)(1, 2)`,
+		`filter(nums, x => x + 1)`,
+		`reduce(filter(nums, x => x > 5), (a, b) => a + b)`,
+		`find(nums, x => x > 5)`,
+		`sortBy(items, x => x)`,
+		`nums(1)`,
+		`let f = x => f(x); f(1)`,
+		`undefined(1)`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+
+	for _, src := range []string{`(a, a) => a`, `(a + 1) => a`, `x =>`, `f(,)`, `f(1`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected a syntax error", src)
+		}
+	}
+
+	deps := NewExpression(`sum(filter(items, x => x.price > min), x => x.price) + x`).Variables()
+	if want := []string{"items", "min", "x"}; !reflect.DeepEqual(deps.Names, want) {
+		t.Errorf("got %v, want %v", deps.Names, want)
+	}
+}
+
+func TestMethods(t *testing.T) {
+	RegisterMethod(Integer, "clamp", func(recv interface{}, args []interface{}) (interface{}, error) {
+		n, lo, hi := recv.(int), args[0].(int), args[1].(int)
+		if n < lo {
+			return lo, nil
+		}
+		if n > hi {
+			return hi, nil
+		}
+		return n, nil
+	})
+	t.Cleanup(func() {
+		methodsMu.Lock()
+		delete(methods[Integer], "clamp")
+		methodsMu.Unlock()
+	})
+
+	params := map[string]interface{}{
+		"name":  " Ann ",
+		"nums":  []int{3, 1, 2},
+		"home":  testAddress{City: "paris"},
+		"work":  &testAddress{City: "rome"},
+		"score": 120,
+	}
+	opts := &EvalOptions{AllowMethods: []string{"testAddress.Label", "testAddress.Move"}}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`name.trim().upper()`, `ANN`},
+		{`name.lower().contains("ann")`, `true`},
+		{`name.trim().startsWith("A") && !name.endsWith("n")`, `true`},
+		{`name.len() + nums.len()`, `8`},
+		{`nums.filter(x => x > 1).map(x => x * 2).sum()`, `10`},
+		{`nums.reduce((a, b) => a + b, 0)`, `6`},
+		{`score.clamp(0, 100) + (-5).clamp(0, 100)`, `100`},
+		{`home.Label("in ") + ", " + work.Label("")`, `in paris, rome`},
+		{`work.Move("oslo") + home.Move("nice")`, `oslonice`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, opts)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+	if work := params["work"].(*testAddress); work.City != "oslo" {
+		t.Errorf("got %s, want the pointer receiver updated", work.City)
+	}
+	if home := params["home"].(testAddress); home.City != "paris" {
+		t.Errorf("got %s, want the value receiver left alone", home.City)
+	}
+
+	for _, src := range []string{
+		`name.missing()`,
+		`name.upper(1)`,
+		`name.contains(1)`,
+		`score.upper()`,
+		`work.Move("")`,
+		`work.Move(1)`,
+		`work.Label()`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, opts); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	if NewExpression(`home.Label("")`).Calc(params) != nil {
+		t.Errorf("expected Go methods to need an allow-list")
+	}
+
+	deps := NewExpression(`name.trim().len() > user.name.len()`).Variables()
+	if want := []string{"name", "user.name"}; !reflect.DeepEqual(deps.Paths, want) {
+		t.Errorf("got %v, want %v", deps.Paths, want)
+	}
+}
+
+func TestTime(t *testing.T) {
+	created := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	now := created.Add(26 * time.Hour)
+	params := map[string]interface{}{
+		"created": created,
+		"due":     &now,
+		"timeout": 90 * time.Second,
+		"tickets": []map[string]interface{}{
+			{"id": 1, "opened": created.Add(time.Hour)},
+			{"id": 2, "opened": created},
+		},
+	}
+	opts := &EvalOptions{Now: func() time.Time { return now }}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`now() - created > 24h`, `true`},
+		{`now() - created`, `26h0m0s`},
+		{`created + 1h30m < due && due <= now()`, `true`},
+		{`created - 30m == parseTime("2024-03-01 09:00", "2006-01-02 15:04")`, `true`},
+		{`timeout * 2 + 1.5s`, `3m1.5s`},
+		{`-timeout / 3 + 2 * 1ms`, `-29.998s`},
+		{`(now() - created) / 1h`, `26`},
+		{`formatTime(created, "DateTime")`, `2024-03-01 09:30:00`},
+		{`created.formatTime("Kitchen", "America/New_York")`, `4:30AM`},
+		{`formatTime(parseTime("2024-03-01 10:00", "2006-01-02 15:04", "Europe/Paris"))`, `2024-03-01T10:00:00+01:00`},
+		{`inZone(created, "Asia/Tokyo").hour()`, `18`},
+		{`parseTime("2024-03-01T09:30:00Z") == created`, `true`},
+		{`parseDuration("1h15m").minutes()`, `75`},
+		{`created.year() * 100 + created.month()`, `202403`},
+		{`created.weekday()`, `Friday`},
+		{`timeout.milliseconds()`, `90000`},
+		{`map(sortBy(tickets, x => x.opened), x => x.id)`, `[2 1]`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, opts)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		`created + created`,
+		`created + 1`,
+		`timeout / 0`,
+		`1h * 1h`,
+		`parseTime("yesterday")`,
+		`formatTime(created, "DateTime", "Mars/Olympus")`,
+		`parseDuration("soon")`,
+		`timeout.year()`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, opts); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	for _, src := range []string{`1x`, `5m3`, `2h.5m`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected a syntax error", src)
+		}
+	}
+
+	result := NewExpression(`created`).Calc(params)
+	if v, err := result.Time(); err != nil || !v.Equal(created) || result.Kind() != Time {
+		t.Errorf("got %v %v, want %v", result.Kind(), v, created)
+	}
+	result = NewExpression(`timeout`).Calc(params)
+	if v, err := result.Duration(); err != nil || v != 90*time.Second || result.Kind() != Duration {
+		t.Errorf("got %v %v, want 1m30s", result.Kind(), v)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	if err := RegisterUnit("kn", 1852, "m/h"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unitsMu.Lock()
+		delete(units, "kn")
+		unitsMu.Unlock()
+	})
+	params := map[string]interface{}{
+		"load":     Measure{Value: 1500, Unit: "g"},
+		"dist":     12,
+		"readings": []Measure{{Value: 2, Unit: "kg"}, {Value: 500, Unit: "g"}},
+	}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`5 kg + 500 g`, `5.5 kg`},
+		{`500 g + 1 kg`, `1500 g`},
+		{`100 m / 10 s`, `10 m/s`},
+		{`9.8 m/s^2 * 2 s`, `19.6 m/s`},
+		{`2 N * 3 m`, `6 N*m`},
+		{`1 km / 1 m`, `1000`},
+		{`quantity(dist, "km") / 2 h`, `6 km/h`},
+		{`to(36 km/h, "m/s")`, `10 m/s`},
+		{`to(1 kWh, "J") == 3600000 J`, `true`},
+		{`to(1 kn, "km/h")`, `1.852 km/h`},
+		{`(2 kg).to("lb") > 4 lb && load < 2 kg`, `true`},
+		{`-load * 2`, `-3000 g`},
+		{`1 / 4 s`, `0.25 s^-1`},
+		{`to(2 Hz, "s^-1")`, `2 s^-1`},
+		{`3 m * 2 m`, `6 m^2`},
+		{`load.value() + 1`, `1501`},
+		{`load.unit()`, `g`},
+		{`sum(readings)`, `2.5 kg`},
+		{`sortBy(readings, x => x)[0]`, `500 g`},
+		{`let l = 10 m; l / 2 + l`, `15 m`},
+		{`12 m / dist`, `1 m`},
+	}
+	for _, c := range cases {
+		result := NewExpression(c.expr).Calc(params)
+		if result == nil {
+			t.Errorf("%s: unexpected error", c.expr)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		`1 kg + 1 m`,
+		`1 kg < 1 s`,
+		`1 kg + 1`,
+		`1 furlong`,
+		`to(1 kg, "m")`,
+		`to(1 kg, "kg/")`,
+		`1 m / 0 s`,
+		`quantity("x", "m")`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	for _, src := range []string{`5 m/`, `5 m/ s`, `5 m^x`, `5 m/m`, `5 kg 3`} {
+		if _, err := Parse(src); err == nil {
+			t.Errorf("%q: expected a syntax error", src)
+		}
+	}
+	for _, err := range []error{
+		RegisterUnit("kn", 1, "m"),
+		RegisterUnit("2x", 1, "m"),
+		RegisterUnit("x", 0, "m"),
+		RegisterUnit("x", 1, "furlong"),
+	} {
+		if err == nil {
+			t.Errorf("expected an error registering a unit")
+		}
+	}
+
+	// the space tells a quantity from a duration
+	for _, c := range []struct {
+		src  string
+		kind Token
+	}{{`5 m`, Quantity}, {`5m`, Duration}, {`2 s`, Quantity}, {`2s`, Duration}, {`1 ms`, Quantity}, {`1ms`, Duration}} {
+		if result := NewExpression(c.src).Calc(params); result == nil || result.Kind() != c.kind {
+			t.Errorf("%s: got %v, want %v", c.src, result, c.kind)
+		}
+	}
+
+	// spaces around an operator leave it out of the unit
+	deps := NewExpression(`5 m / s + 1 m/s`).Variables()
+	if want := []string{"s"}; !reflect.DeepEqual(deps.Names, want) {
+		t.Errorf("got %v, want %v", deps.Names, want)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	params := map[string]interface{}{
+		"price": Amount{Value: big.NewRat(1999, 100), Currency: "EUR"},
+		"fee":   Amount{Value: big.NewRat(150, 1), Currency: "JPY"},
+		"lines": []Amount{
+			{Value: big.NewRat(10, 1), Currency: "EUR"},
+			{Value: big.NewRat(5, 2), Currency: "EUR"},
+		},
+		"qty":  3,
+		"list": 1234567.89,
+	}
+	rates := RateFunc(func(from, to string) (*big.Rat, error) {
+		if from == "USD" && to == "EUR" {
+			return big.NewRat(9, 10), nil
+		}
+		if from == "EUR" && to == "USD" {
+			return big.NewRat(10, 9), nil
+		}
+		return nil, fmt.Errorf("no rate from %s to %s", from, to)
+	})
+	opts := &EvalOptions{Rates: rates}
+
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`price * qty`, `59.97 EUR`},
+		{`money(12.50, "EUR") + 0.1 EUR + money("0.2", "EUR")`, `12.80 EUR`},
+		{`money(0.1, "USD") + money(0.2, "USD") == money(0.3, "USD")`, `true`},
+		{`price + 10 USD`, `28.99 EUR`},
+		{`to(9 EUR, "USD")`, `10.00 USD`},
+		{`price / 3`, `6.66 EUR`},
+		{`round(price / 3, "up")`, `6.67 EUR`},
+		{`round(2.345 EUR) + round(2.355 EUR)`, `4.70 EUR`},
+		{`round(2.345 EUR, "halfUp")`, `2.35 EUR`},
+		{`round(-2.345 EUR, "floor")`, `-2.35 EUR`},
+		{`round(-2.345 EUR, "down")`, `-2.34 EUR`},
+		{`round(fee / 7)`, `21 JPY`},
+		{`round(1.0005 KWD)`, `1.000 KWD`},
+		{`-price`, `-19.99 EUR`},
+		{`2 * sum(lines)`, `25.00 EUR`},
+		{`sum(lines) / price > 0.6`, `true`},
+		{`sortBy(lines, x => x)[0]`, `2.50 EUR`},
+		{`price.currency() + " " + fee.currency()`, `EUR JPY`},
+		{`price.amount() > 19.9`, `true`},
+		{`price >= 19.99 EUR && price < 20 EUR`, `true`},
+		{`money(1234567.89, "EUR")`, `1234567.89 EUR`},
+		{`money(-1234567.89, "EUR") + 1234567.89 EUR`, `0.00 EUR`},
+		{`money(list, "EUR") == 1234567.89 EUR`, `true`},
+		{`list.money("EUR")`, `1234567.89 EUR`},
+		{`money("-1234567.89", "EUR")`, `-1234567.89 EUR`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, opts)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	exact := NewExpression(`price / 3 * 3 == price`).Calc(params)
+	if exact == nil || exact.data != true {
+		t.Errorf("expected exact decimal arithmetic")
+	}
+	for _, src := range []string{
+		`price + 1`,
+		`price * price`,
+		`price + fee`,
+		`price / 0`,
+		`money(1, "XYZ")`,
+		`money("1,5", "EUR")`,
+		`money("1/3", "EUR")`,
+		`money("1e3", "EUR")`,
+		`money("-", "EUR")`,
+		`round(price, "sideways")`,
+		`to(price, "GBP")`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, opts); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	if NewExpression(`price + 10 USD`).Calc(params) != nil {
+		t.Errorf("expected mixed currencies to need rates")
+	}
+
+	if err := RegisterCurrency("XTS", 4); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(NewExpression(`1.23456 XTS`).Calc(nil).data); got != "1.2346 XTS" {
+		t.Errorf("got %s, want 1.2346 XTS", got)
+	}
+	if RegisterCurrency("eur", 2) == nil || RegisterCurrency("EUR", -1) == nil {
+		t.Errorf("expected an error registering a currency")
+	}
+}
+
+func TestComplex(t *testing.T) {
+	params := map[string]interface{}{
+		"z":  complex(3, 4),
+		"zs": []complex64{1 + 1i, 2 - 1i},
+	}
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`3i`, `(0+3i)`},
+		{`1 + 2.5i`, `(1+2.5i)`},
+		{`z * 2i`, `(-8+6i)`},
+		{`z / (1 + 2i)`, `(2.2-0.4i)`},
+		{`z - 3 == 4i`, `true`},
+		{`z != conj(z)`, `true`},
+		{`-z`, `(-3-4i)`},
+		{`abs(z)`, `5`},
+		{`abs(-7) + abs(-1.5)`, `8.5`},
+		{`real(z) + imag(z)`, `7`},
+		{`phase(1i) * 2`, `3.1415927`},
+		{`1i ** 2`, `(-1+0i)`},
+		{`complex(1, -2)`, `(1-2i)`},
+		{`sum(zs)`, `(3+0i)`},
+		{`2 ** 3 ** 2`, `512`},
+		{`2 ** -1`, `0.5`},
+		{`2 ** 62 + (-2) ** 63`, `-4611686018427387904`},
+		{`(-1) ** 1000000000001 + 1 ** 1000000000000`, `0`},
+		{`2.0 ** 64`, `1.8446744e+19`},
+		{`-2 ** 2`, `-4`},
+		{`(-2) ** 2 + -2 ** 3 ** 0`, `2`},
+		{`2.0 ** 0.5 > 1.41`, `true`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		`z > 1`,
+		`1i <= z`,
+		`z / 0`,
+		`z % 2`,
+		`real("3")`,
+		`sortBy(zs, x => x)`,
+		`2 ** 64`,
+		`(-3) ** 41`,
+		`10 ** 19`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	if _, err := NewExpression(`z < 1`).EvalContext(context.Background(), params, nil); err == nil || !strings.Contains(err.Error(), "not ordered") {
+		t.Errorf("expected an ordering error, got %v", err)
+	}
+	if c, err := NewExpression(`conj(z)`).Calc(params).Complex(); err != nil || c != 3-4i {
+		t.Errorf("got %v, %v, want (3-4i)", c, err)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	params := map[string]interface{}{
+		"name":     "Zoë Straße",
+		"zoe":      "Zoë",
+		"city":     "Straße",
+		"nfd":      "Zoe\u0308",
+		"ligature": "\ufb01le",
+		"words":    []string{"été", "Eva", "zèbre", "adam"},
+		"initial":  Rune('Z'),
+	}
+	cases := []struct {
+		expr string
+		opts EvalOptions
+		want string
+	}{
+		{`len(name)`, EvalOptions{}, `10`},
+		{`name[2]`, EvalOptions{}, `235`},
+		{`name[2] == 'ë' && 'a' < 'b'`, EvalOptions{}, `true`},
+		{`zoe + name[3] + '!'`, EvalOptions{}, `Zoë !`},
+		{`name.upper()`, EvalOptions{}, `ZOË STRASSE`},
+		{`city.fold()`, EvalOptions{}, `strasse`},
+		{`city.equalFold("STRASSE")`, EvalOptions{}, `true`},
+		{`"a" + "b" < "ab" + 'c'`, EvalOptions{}, `true`},
+		{`zoe == nfd`, EvalOptions{}, `false`},
+		{`zoe == nfd`, EvalOptions{Normalization: NFC}, `true`},
+		{`name.startsWith(nfd)`, EvalOptions{Normalization: NFC}, `true`},
+		{`ligature == "file"`, EvalOptions{Normalization: NFC}, `false`},
+		{`ligature == "file"`, EvalOptions{Normalization: NFKC}, `true`},
+		{`"ZOË" == nfd`, EvalOptions{Normalization: NFC, FoldCase: true}, `true`},
+		{`sortBy(words, x => x)[0]`, EvalOptions{}, `Eva`},
+		{`sortBy(words, x => x)[0]`, EvalOptions{FoldCase: true}, `adam`},
+		{`sortBy(words, x => x[0])[3]`, EvalOptions{}, `été`},
+		{`map(words, x => x[0])`, EvalOptions{}, `[é E z a]`},
+		{`map(words, x => 'a')[1] == 'a' && map(words, x => x[-1])[2] > 'a'`, EvalOptions{}, `true`},
+		{`initial == 'Z'`, EvalOptions{}, `true`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, &c.opts)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	for _, src := range []string{
+		`'a' + 1`,
+		`'1' > 321`,
+		`'a' + 'b'`,
+		`'a' == "a"`,
+		`name[10]`,
+		`name["a"]`,
+	} {
+		expr, err := Compile(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if _, err := expr.EvalContext(context.Background(), params, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+	for _, src := range []string{`'ab'`, `''`, `"\xff"`} {
+		if _, err := Compile(src); err == nil {
+			t.Errorf("%s: expected a syntax error", src)
+		}
+	}
+	if c, err := NewExpression(`'\u00e9'`).Calc(nil).Char(); err != nil || c != 'é' {
+		t.Errorf("got %q, %v, want 'é'", c, err)
+	}
+}
+
+func TestSlices(t *testing.T) {
+	params := map[string]interface{}{
+		"s":     "héllo",
+		"items": []int{1, 2, 3, 4, 5},
+		"pair":  [2]string{"a", "b"},
+		"ptr":   &[]float64{1.5, 2.5},
+		"m":     map[int]string{-1: "minus one"},
+	}
+	cases := []struct {
+		expr string
+		want string
+	}{
+		{`s[1:3]`, `él`},
+		{`s[:2] + s[-2:]`, `hélo`},
+		{`s[-1]`, `111`},
+		{`s[-5:-4]`, `h`},
+		{`s[2:2]`, ``},
+		{`items[1:3]`, `[2 3]`},
+		{`items[:2]`, `[1 2]`},
+		{`items[3:]`, `[4 5]`},
+		{`items[:]`, `[1 2 3 4 5]`},
+		{`items[-1] + items[-5]`, `6`},
+		{`items[-3:-1]`, `[3 4]`},
+		{`sum(items[1:])`, `14`},
+		{`items[1:4][-1]`, `4`},
+		{`len(items[:0])`, `0`},
+		{`pair[1:]`, `[b]`},
+		{`pair[-2]`, `a`},
+		{`ptr[-1:]`, `[2.5]`},
+		{`m[-1]`, `minus one`},
+	}
+	for _, c := range cases {
+		expr, err := Compile(c.expr)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		result, err := expr.EvalContext(context.Background(), params, nil)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got := fmt.Sprint(result.data); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.expr, got, c.want)
+		}
+	}
+
+	errs := []struct {
+		expr   string
+		target interface{}
+	}{
+		{`items[5]`, new(*IndexError)},
+		{`items[-6]`, new(*IndexError)},
+		{`s[-6]`, new(*IndexError)},
+		{`items[2:1]`, new(*SliceError)},
+		{`items[:6]`, new(*SliceError)},
+		{`items[-6:]`, new(*SliceError)},
+		{`s[3:-3]`, new(*SliceError)},
+	}
+	for _, c := range errs {
+		_, err := NewExpression(c.expr).EvalContext(context.Background(), params, nil)
+		if !errors.As(err, c.target) {
+			t.Errorf("%s: got %v, want %T", c.expr, err, c.target)
+		}
+	}
+	var serr *SliceError
+	if _, err := NewExpression(`items[-1:2]`).EvalContext(context.Background(), params, nil); !errors.As(err, &serr) ||
+		*serr != (SliceError{Lo: -1, Hi: 2, Len: 5}) {
+		t.Errorf("got %v, want the bounds as written", err)
+	}
+	for _, src := range []string{`items["a":]`, `items[:1.5]`, `m[0:1]`, `1[0:1]`} {
+		if _, err := NewExpression(src).EvalContext(context.Background(), params, nil); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+}
+
+func TestAssign(t *testing.T) {
+	opts := ParseOptions{AllowAssign: true}
+	eval := func(src string, v interface{}) error {
+		expr, err := CompileWithOptions(src, opts)
+		if err != nil {
+			return err
+		}
+		_, err = expr.EvalContext(context.Background(), v, nil)
+		return err
+	}
+
+	out := map[string]interface{}{}
+	params := map[string]interface{}{
+		"in":    map[string]interface{}{"price": 3, "qty": 4},
+		"out":   out,
+		"items": []int{1, 2, 3},
+		"n":     10,
+	}
+	src := `out.total = in.price * in.qty; out.total += 1; items[1] -= 2; n = n * 2; let k = "key"; out[k] = n`
+	if err := eval(src, params); err != nil {
+		t.Fatal(err)
+	}
+	if out["total"] != 13 || out["key"] != 20 || params["n"] != 20 || params["items"].([]int)[1] != 0 {
+		t.Errorf("got %v", params)
+	}
+
+	// a Float is stored as a float64, or as the type of the entry it replaces
+	floats := map[string]interface{}{"ratio": float32(0)}
+	vars := map[string]interface{}{"in": params["in"], "out": floats, "rate": 0.5, "xs": []interface{}{1.5}}
+	if err := eval(`out.avg = in.price * 2.5; out.ratio = 0.1; out["n"] = 1.5; rate = rate * 3; xs[0] = 0.1`, vars); err != nil {
+		t.Fatal(err)
+	}
+	if floats["avg"] != 7.5 || floats["ratio"] != float32(0.1) || floats["n"] != 1.5 ||
+		vars["rate"] != 1.5 || vars["xs"].([]interface{})[0] != 0.1 {
+		t.Errorf("got %#v %#v", floats, vars)
+	}
+
+	// a Char stays a Char when it is read back
+	runes := []rune("ab")
+	params["runes"] = runes
+	if err := eval(`out.c = 'é'; out.same = out.c == 'é'; runes[0] = out.c`, params); err != nil {
+		t.Fatal(err)
+	}
+	if out["c"] != Rune('é') || out["same"] != true || runes[0] != 'é' {
+		t.Errorf("got %v %v", out, runes)
+	}
+
+	user := &testUser{Age: 30, Address: &testAddress{City: "paris"}}
+	if err := eval(`age -= 1; score = 2; address.city = "rome"`, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Age != 29 || user.Score != 2 || user.Address.City != "rome" {
+		t.Errorf("got %+v %+v", user, user.Address)
+	}
+	if err := eval(`score = 2.1`, user); err != nil || user.Score != 2.1 {
+		t.Errorf("got %v %v, want 2.1", user.Score, err)
+	}
+	for _, src := range []string{`age = 1.5`, `name = 1`, `missing = 1`, `tags[5] = "x"`} {
+		if err := eval(src, user); err == nil {
+			t.Errorf("%s: expected an error", src)
+		}
+	}
+
+	expr, err := CompileWithOptions(`out.total = a * b; c += 1`, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := expr.Variables()
+	if want := []string{"c", "out.total"}; !reflect.DeepEqual(deps.Writes, want) {
+		t.Errorf("writes: got %v, want %v", deps.Writes, want)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(deps.Names, want) {
+		t.Errorf("names: got %v, want %v", deps.Names, want)
+	}
+
+	if _, err := Compile(`a = 1`); err == nil {
+		t.Errorf("expected assignments to be rejected by default")
+	}
+	if _, err := CompileWithOptions(`a + b = 1`, opts); err == nil {
+		t.Errorf("expected an error for a target that is not assignable")
+	}
+}
+
+func TestCalcWithResolver(t *testing.T) {
+	var asked []string
+	resolver := ResolverFunc(func(name string) (interface{}, bool, error) {
+		asked = append(asked, name)
+		if name == "price" {
+			return 40, true, nil
+		}
+		return nil, false, nil
+	})
+
+	result := NewExpression(`price * 2`).CalcWith(resolver)
+	if result == nil {
+		t.Fatal("unexpected error")
+	}
+	if v, _ := result.Int(); v != 80 {
+		t.Errorf("got %v, want 80", v)
+	}
+	if len(asked) != 1 || asked[0] != "price" {
+		t.Errorf("resolved %v, want [price]", asked)
+	}
+
+	if result := NewExpression(`qty`).CalcWith(resolver); result != nil {
+		t.Errorf("expected undefined variable, got %v", result.data)
+	}
+}
+
+func TestEvalContextLimits(t *testing.T) {
+	params := map[string]interface{}{
+		"s":     "abcdef",
+		"items": []int{1, 2, 3, 4},
+	}
+	cases := []struct {
+		expr   string
+		opts   EvalOptions
+		target interface{}
+	}{
+		{`1 + 2 + 3 + 4`, EvalOptions{MaxSteps: 5}, new(*StepLimitError)},
+		{`-(-(-(-1)))`, EvalOptions{MaxDepth: 3}, new(*DepthLimitError)},
+		{`s + s`, EvalOptions{MaxStringLen: 10}, new(*StringLimitError)},
+		{`items[0]`, EvalOptions{MaxCollectionSize: 3}, new(*CollectionLimitError)},
+	}
+	for _, c := range cases {
+		_, err := NewExpression(c.expr).EvalContext(context.Background(), params, &c.opts)
+		if !errors.As(err, c.target) {
+			t.Errorf("%s: got %v, want %T", c.expr, err, c.target)
+		}
+
+		c.opts = EvalOptions{}
+		if _, err := NewExpression(c.expr).EvalContext(context.Background(), params, &c.opts); err != nil {
+			t.Errorf("%s: unexpected error without limits: %v", c.expr, err)
+		}
+	}
+}
+
+func TestEvalContextCanceled(t *testing.T) {
+	src := "1"
+	for i := 0; i < 200; i++ {
+		src += " + 1"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, src := range []string{src, `1 + 1`, `x`} {
+		_, err := NewExpression(src).EvalContext(ctx, map[string]interface{}{"x": 1}, nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%.10s: got %v, want %v", src, err, context.Canceled)
+		}
+	}
+}
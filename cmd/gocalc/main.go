@@ -0,0 +1,445 @@
+// Command gocalc evaluates go-calc expressions.
+//
+// Usage:
+//
+//	gocalc [-var name=value]... [-params file] [expr...]
+//
+// Expressions given as arguments are evaluated in order and their results
+// printed one per line. Without arguments, expressions are read from
+// standard input one per line, or, when standard input is a terminal, an
+// interactive session is started. Type :help in the session for the list
+// of commands.
+//
+// Variables are bound with -var, whose value is read as an integer, a
+// float, a bool or a JSON value before falling back to a plain string, and
+// with -params, which loads a JSON or YAML object. A .yaml or .yml file is
+// read as YAML; anything else as JSON.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	gocalc "github.com/zyldgd/go-calc"
+	"gopkg.in/yaml.v3"
+)
+
+const historyFile = ".gocalc_history"
+
+type varFlags []string
+
+func (v *varFlags) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *varFlags) Set(s string) error {
+	*v = append(*v, s)
+	return nil
+}
+
+func main() {
+	var vars varFlags
+	flag.Var(&vars, "var", "bind a variable, as `name=value`; may be repeated")
+	paramsFile := flag.String("params", "", "load variables from a JSON or YAML `file`")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: gocalc [-var name=value]... [-params file] [expr...]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	params := make(map[string]interface{})
+	if *paramsFile != "" {
+		if err := loadParams(*paramsFile, params); err != nil {
+			fatalf("gocalc: %v", err)
+		}
+	}
+	for _, v := range vars {
+		if err := setVar(params, v); err != nil {
+			fatalf("gocalc: %v", err)
+		}
+	}
+
+	switch {
+	case flag.NArg() > 0:
+		os.Exit(evalAll(flag.Args(), params))
+	case !isTerminal(os.Stdin):
+		os.Exit(evalLines(os.Stdin, params))
+	default:
+		newREPL(params).run(os.Stdin, os.Stdout)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(2)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ------------------------------------------------------------------
+
+// evalAll evaluates each expression of srcs and returns the exit status.
+func evalAll(srcs []string, params map[string]interface{}) int {
+	status := 0
+	for _, src := range srcs {
+		r, err := eval(src, params)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", src, err)
+			status = 1
+			continue
+		}
+		fmt.Println(formatResult(r))
+	}
+	return status
+}
+
+// evalLines evaluates every non-blank line of r and returns the exit status.
+func evalLines(r io.Reader, params map[string]interface{}) int {
+	var srcs []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			srcs = append(srcs, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "gocalc: %v\n", err)
+		return 2
+	}
+	return evalAll(srcs, params)
+}
+
+func eval(src string, params map[string]interface{}) (*gocalc.Result, error) {
+	expr, err := gocalc.Compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return expr.EvalContext(context.Background(), params, nil)
+}
+
+func formatResult(r *gocalc.Result) string {
+	switch v := r.Value().(type) {
+	case string:
+		return strconv.Quote(v)
+	case nil:
+		return "nil"
+	}
+	if c, err := r.Char(); err == nil && r.Kind() == gocalc.Char {
+		return strconv.QuoteRune(c)
+	}
+	if r.Kind() == gocalc.Object {
+		if b, err := json.Marshal(r.Value()); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(r.Value())
+}
+
+// ------------------------------------------------------------------
+
+// setVar binds a name=value assignment in params.
+func setVar(params map[string]interface{}, assign string) error {
+	i := strings.IndexByte(assign, '=')
+	if i < 0 {
+		return fmt.Errorf("wrong variable[%s], want name=value", assign)
+	}
+	name := strings.TrimSpace(assign[:i])
+	if name == "" {
+		return fmt.Errorf("wrong variable[%s], want name=value", assign)
+	}
+	params[name] = parseValue(assign[i+1:])
+	return nil
+}
+
+// parseValue reads s as an integer, a float, a bool or a JSON value, and
+// falls back to the string itself.
+func parseValue(s string) interface{} {
+	if v, err := strconv.Atoi(s); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v
+	}
+	if v, err := strconv.ParseBool(s); err == nil {
+		return v
+	}
+	if v, err := decodeJSON([]byte(s)); err == nil {
+		return v
+	}
+	return s
+}
+
+// loadParams reads the variables of a JSON or YAML file into params.
+func loadParams(path string, params map[string]interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var v interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &v)
+	default:
+		v, err = decodeJSON(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: params must be an object", path)
+	}
+	for k, val := range m {
+		params[k] = val
+	}
+	return nil
+}
+
+// decodeJSON decodes data keeping integral numbers as int, so that they
+// evaluate as integers rather than floats.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return normalize(v), nil
+}
+
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := strconv.Atoi(x.String()); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, val := range x {
+			x[k] = normalize(val)
+		}
+	case []interface{}:
+		for i, val := range x {
+			x[i] = normalize(val)
+		}
+	}
+	return v
+}
+
+// ------------------------------------------------------------------
+
+const replHelp = `expressions are evaluated and their result printed.
+commands:
+  :ast <expr>        print the syntax tree of expr
+  :tokens <expr>     print the tokens of expr
+  :type <expr>       print the kind of the result of expr
+  :vars [expr]       list the bound variables, or the variables expr reads
+  :set name=value    bind a variable
+  :history           list the history
+  !n                 run history entry n again
+  :help              print this help
+  :quit              leave the session`
+
+type repl struct {
+	params  map[string]interface{}
+	history []string
+	hist    *os.File // appended to, may be nil
+	out     io.Writer
+}
+
+func newREPL(params map[string]interface{}) *repl {
+	r := &repl{params: params}
+	if home, err := os.UserHomeDir(); err == nil {
+		path := filepath.Join(home, historyFile)
+		if data, err := ioutil.ReadFile(path); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if line != "" {
+					r.history = append(r.history, line)
+				}
+			}
+		}
+		r.hist, _ = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	}
+	return r
+}
+
+func (r *repl) run(in io.Reader, out io.Writer) {
+	r.out = out
+	defer func() {
+		if r.hist != nil {
+			r.hist.Close()
+		}
+	}()
+
+	fmt.Fprintln(out, "gocalc, type :help for help")
+	sc := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "> ")
+		if !sc.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		// !3 runs entry 3 again, while !flag is an expression
+		if isRecall(line) {
+			n, err := strconv.Atoi(line[1:])
+			if err != nil || n < 1 || n > len(r.history) {
+				fmt.Fprintf(out, "no history entry[%s]\n", line[1:])
+				continue
+			}
+			line = r.history[n-1]
+			fmt.Fprintln(out, line)
+		}
+		r.record(line)
+
+		if !r.exec(line) {
+			return
+		}
+	}
+}
+
+// isRecall reports whether line is !n, a recall of history entry n.
+func isRecall(line string) bool {
+	if len(line) < 2 || line[0] != '!' {
+		return false
+	}
+	for _, c := range line[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *repl) record(line string) {
+	r.history = append(r.history, line)
+	if r.hist != nil {
+		fmt.Fprintln(r.hist, line)
+	}
+}
+
+// exec runs one line and reports whether the session goes on.
+func (r *repl) exec(line string) bool {
+	if !strings.HasPrefix(line, ":") {
+		r.eval(line)
+		return true
+	}
+
+	cmd, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	switch cmd {
+	case ":quit", ":q", ":exit":
+		return false
+	case ":help":
+		fmt.Fprintln(r.out, replHelp)
+	case ":ast":
+		r.ast(arg)
+	case ":tokens":
+		r.tokens(arg)
+	case ":type":
+		if res, err := eval(arg, r.params); err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		} else {
+			fmt.Fprintln(r.out, res.Kind())
+		}
+	case ":vars":
+		r.vars(arg)
+	case ":set":
+		if err := setVar(r.params, arg); err != nil {
+			fmt.Fprintf(r.out, "error: %v\n", err)
+		}
+	case ":history":
+		for i, h := range r.history {
+			fmt.Fprintf(r.out, "%5d  %s\n", i+1, h)
+		}
+	default:
+		fmt.Fprintf(r.out, "unknown command[%s], type :help for help\n", cmd)
+	}
+	return true
+}
+
+func (r *repl) eval(src string) {
+	res, err := eval(src, r.params)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(r.out, formatResult(res))
+}
+
+func (r *repl) ast(src string) {
+	expr, err := gocalc.Parse(src)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	b, err := json.MarshalIndent(expr, "", "    ")
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(r.out, "ast:\n%s\n", b)
+}
+
+func (r *repl) tokens(src string) {
+	s := gocalc.NewScanner(src)
+	for {
+		tok, lit := s.Scan()
+		if tok == gocalc.EOF {
+			return
+		}
+		fmt.Fprintf(r.out, "%-10s %s\n", tok, lit)
+		if tok == gocalc.Illegal {
+			return
+		}
+	}
+}
+
+func (r *repl) vars(src string) {
+	if src == "" {
+		names := make([]string, 0, len(r.params))
+		for name := range r.params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(r.out, "%s = %v\n", name, r.params[name])
+		}
+		return
+	}
+
+	expr, err := gocalc.Compile(src)
+	if err != nil {
+		fmt.Fprintf(r.out, "error: %v\n", err)
+		return
+	}
+	for _, path := range expr.Variables().Paths {
+		fmt.Fprintln(r.out, path)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseValue(t *testing.T) {
+	cases := []struct {
+		s    string
+		want interface{}
+	}{
+		{`42`, 42},
+		{`-7`, -7},
+		{`2.5`, 2.5},
+		{`true`, true},
+		{`false`, false},
+		{`"quoted"`, "quoted"},
+		{`[1, 2.5]`, []interface{}{1, 2.5}},
+		{`{"a": {"b": 3}}`, map[string]interface{}{"a": map[string]interface{}{"b": 3}}},
+		{`paris`, "paris"},
+		{`{"a": 1} x`, `{"a": 1} x`},
+		{``, ""},
+	}
+	for _, c := range cases {
+		if got := parseValue(c.s); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%q: got %#v, want %#v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestSetVar(t *testing.T) {
+	params := map[string]interface{}{}
+	for _, assign := range []string{`n=3`, ` name = ann`, `expr=a=b`, `empty=`} {
+		if err := setVar(params, assign); err != nil {
+			t.Errorf("%s: %v", assign, err)
+		}
+	}
+	want := map[string]interface{}{"n": 3, "name": " ann", "expr": "a=b", "empty": ""}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("got %#v, want %#v", params, want)
+	}
+
+	for _, assign := range []string{`n`, `=3`, ` =3`} {
+		if err := setVar(params, assign); err == nil {
+			t.Errorf("%s: expected an error", assign)
+		}
+	}
+}
+
+func TestLoadParams(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"p.json":  `{"n": 3, "price": 2.5, "user": {"tags": ["a"]}}`,
+		"p.yaml":  "n: 3\nprice: 2.5\nuser:\n  tags: [a]\n",
+		"p.YML":   "n: 3\nprice: 2.5\nuser:\n  tags: [a]\n",
+		"list.js": `[1, 2]`,
+		"bad.yml": "n: [",
+		"bad":     `{"n": 3} {}`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"p.json", "p.yaml", "p.YML"} {
+		params := map[string]interface{}{"kept": true}
+		if err := loadParams(filepath.Join(dir, name), params); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if params["n"] != 3 || params["price"] != 2.5 || params["kept"] != true {
+			t.Errorf("%s: got %#v", name, params)
+		}
+		if r, err := eval(`user.tags[0] + "!"`, params); err != nil || formatResult(r) != `"a!"` {
+			t.Errorf("%s: got %v %v", name, r, err)
+		}
+	}
+	for _, name := range []string{"list.js", "bad.yml", "bad", "missing.json"} {
+		if err := loadParams(filepath.Join(dir, name), map[string]interface{}{}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestREPL(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  []string // lines the output contains, in order
+	}{
+		{"eval", "1 + 2\nname\n", []string{"> 3", `> "ann"`}},
+		{"error", "1 +\n", []string{"> error: "}},
+		{"not", "!flag\n!(1 > 2)\n", []string{"> false", "> true"}},
+		{"recall", "n * 2\n!1\n!9\n:history\n", []string{"> 8", "> n * 2", "8", "> no history entry[9]", "1  n * 2", "2  n * 2"}},
+		{"set", ":set n=10\nn + 1\n:set x\n", []string{"> > 11", "> error: wrong variable[x]"}},
+		{"type", ":type n / 2.0\n", []string{"> FLOAT"}},
+		{"vars", ":vars\n:vars user.age + n\n", []string{"> flag = true", "n = 4", "name = ann", "> n", "user.age"}},
+		{"ast", ":ast a + 1\n", []string{"> ast:", `"Op"`}},
+		{"tokens", ":tokens a+1\n", []string{"> IDENT", "+", "INT"}},
+		{"help", ":help\n", []string{":quit"}},
+		{"unknown", ":nope\n", []string{"> unknown command[:nope]"}},
+	}
+	for _, c := range cases {
+		params := map[string]interface{}{"n": 4, "name": "ann", "flag": true}
+		var out bytes.Buffer
+		(&repl{params: params}).run(strings.NewReader(c.input), &out)
+
+		got := out.String()
+		rest := got
+		for _, want := range c.want {
+			i := strings.Index(rest, want)
+			if i < 0 {
+				t.Errorf("%s: output does not contain %q in order:\n%s", c.name, want, got)
+				break
+			}
+			rest = rest[i+len(want):]
+		}
+	}
+
+	var out bytes.Buffer
+	(&repl{params: map[string]interface{}{}}).run(strings.NewReader(":quit\n1 + 2\n"), &out)
+	if strings.Contains(out.String(), "3") {
+		t.Errorf(":quit did not end the session:\n%s", out.String())
+	}
+}
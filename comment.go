@@ -0,0 +1,54 @@
+package gocalc
+
+import (
+	"strings"
+)
+
+// CommentMap maps the nodes of a tree to the comments attached to them, as
+// returned by ParseWithComments. A comment that lies before its node is a
+// leading comment; otherwise it is a trailing one. Nodes rebuilt by
+// Rewrite lose their comments.
+type CommentMap map[Expr][]TokenInfo
+
+// NewCommentMap attaches each comment to the nearest node of e: to the
+// node that ends right before it when the comment starts on the same line
+// and is no farther from it than from the node after it, and otherwise to
+// the node that starts right after it. A line comment always stays with a
+// node on its own line if there is one. Of nested nodes sharing a
+// boundary, the outermost one is chosen.
+func NewCommentMap(e Expr, comments []TokenInfo) CommentMap {
+	var nodes []Expr // in pre-order, outer nodes first
+	Inspect(e, func(n Expr) bool {
+		if n != nil && n.Pos().IsValid() {
+			nodes = append(nodes, n)
+		}
+		return true
+	})
+
+	cmap := make(CommentMap)
+	for _, c := range comments {
+		var before, after Expr
+		for _, n := range nodes {
+			if pos := n.Pos().Offset; pos >= c.End.Offset {
+				if after == nil || pos < after.Pos().Offset {
+					after = n
+				}
+			} else if end := n.End().Offset; end <= c.Pos.Offset {
+				if before == nil || end > before.End().Offset {
+					before = n
+				}
+			}
+		}
+
+		n := after
+		if before != nil && (after == nil || c.Pos.Line == before.End().Line &&
+			(strings.HasPrefix(c.Literal, "//") ||
+				c.Pos.Offset-before.End().Offset <= after.Pos().Offset-c.End.Offset)) {
+			n = before
+		}
+		if n != nil {
+			cmap[n] = append(cmap[n], c)
+		}
+	}
+	return cmap
+}
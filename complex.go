@@ -0,0 +1,181 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+)
+
+// complexOf returns the value of an Integer, a Float or a Complex as a
+// complex number.
+func complexOf(r *Result) (complex128, bool) {
+	switch v := r.data.(type) {
+	case int:
+		return complex(float64(v), 0), r.kind == Integer
+	case float32:
+		return complex(float64(v), 0), r.kind == Float
+	case complex128:
+		return v, r.kind == Complex
+	}
+	return 0, false
+}
+
+// complexBinary applies op to operands one of which at least is a Complex,
+// the other one being promoted from an Integer or a Float. Complex numbers
+// are not ordered, only == and != compare them.
+func complexBinary(op Token, l, r *Result) (*Result, error) {
+	x, lok := complexOf(l)
+	y, rok := complexOf(r)
+	if lok && rok {
+		switch op {
+		case OpAdd:
+			return complexResult(x + y), nil
+		case OpMinus:
+			return complexResult(x - y), nil
+		case OpMultiply:
+			return complexResult(x * y), nil
+		case OpDivide:
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			return complexResult(x / y), nil
+		case OpPower:
+			return complexResult(complexPow(x, y)), nil
+		case OpEq:
+			return &Result{kind: Bool, data: x == y}, nil
+		case OpNeq:
+			return &Result{kind: Bool, data: x != y}, nil
+		case OpGt, OpLt, OpGte, OpLte:
+			return nil, fmt.Errorf("complex numbers are not ordered[%v %s %v]", l.kind, op, r.kind)
+		}
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+}
+
+// complexPow returns x ** y, multiplying exactly for small integer
+// exponents so that 1i ** 2 is -1.
+func complexPow(x, y complex128) complex128 {
+	n := real(y)
+	if imag(y) != 0 || n != math.Trunc(n) || math.Abs(n) > 64 {
+		return cmplx.Pow(x, y)
+	}
+	p := complex(1, 0)
+	for i := 0; i < int(math.Abs(n)); i++ {
+		p *= x
+	}
+	if n < 0 {
+		return 1 / p
+	}
+	return p
+}
+
+func complexResult(c complex128) *Result {
+	return &Result{kind: Complex, data: c}
+}
+
+// power returns l ** r for Integer and Float operands. An Integer raised
+// to a non-negative Integer stays an Integer, and is an error when it
+// overflows.
+func power(l, r *Result) (*Result, error) {
+	x, lok := l.data.(int)
+	y, rok := r.data.(int)
+	if lok && rok && l.kind == Integer && r.kind == Integer && y >= 0 {
+		n, ok := intPow(x, y)
+		if !ok {
+			return nil, fmt.Errorf("integer overflow[%d %s %d]", x, OpPower, y)
+		}
+		return intResult(n), nil
+	}
+	a, lok := number(l)
+	b, rok := number(r)
+	if lok && rok {
+		return floatResult(math.Pow(a, b)), nil
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, OpPower, r.kind)
+}
+
+// intPow returns x ** y for y >= 0, by squaring, and false when it
+// overflows an int.
+func intPow(x, y int) (int, bool) {
+	n := 1
+	for ; y > 0; y >>= 1 {
+		var ok bool
+		if y&1 == 1 {
+			if n, ok = mulInt(n, x); !ok {
+				return 0, false
+			}
+		}
+		if y > 1 {
+			if x, ok = mulInt(x, x); !ok {
+				return 0, false
+			}
+		}
+	}
+	return n, true
+}
+
+// mulInt returns a * b, and false when it overflows an int.
+func mulInt(a, b int) (int, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if c/b != a || a == -1 && b == math.MinInt || b == -1 && a == math.MinInt {
+		return 0, false
+	}
+	return c, true
+}
+
+// ------------------------------------------------------------------
+
+// builtinComplex returns complex(re, im).
+func builtinComplex(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("complex", args, 2, 2); err != nil {
+		return nil, err
+	}
+	re, ok := number(args[0])
+	if !ok {
+		return nil, fmt.Errorf("complex: wrong argument type[%v]", args[0].kind)
+	}
+	im, ok := number(args[1])
+	if !ok {
+		return nil, fmt.Errorf("complex: wrong argument type[%v]", args[1].kind)
+	}
+	return complexResult(complex(re, im)), nil
+}
+
+// builtinAbs returns the absolute value of an Integer or a Float, and the
+// modulus of a Complex.
+func builtinAbs(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("abs", args, 1, 1); err != nil {
+		return nil, err
+	}
+	switch v := args[0].data.(type) {
+	case int:
+		if v < 0 {
+			v = -v
+		}
+		return intResult(v), nil
+	case float32:
+		return &Result{kind: Float, data: float32(math.Abs(float64(v)))}, nil
+	case complex128:
+		return floatResult(cmplx.Abs(v)), nil
+	}
+	return nil, fmt.Errorf("abs: wrong argument type[%v]", args[0].kind)
+}
+
+// complexFunc returns a built-in of one numeric argument, promoted to a
+// complex number.
+func complexFunc(name string, f func(c complex128) *Result) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		c, ok := complexOf(args[0])
+		if !ok {
+			return nil, fmt.Errorf("%s: wrong argument type[%v]", name, args[0].kind)
+		}
+		return f(c), nil
+	}
+}
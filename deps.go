@@ -0,0 +1,165 @@
+package gocalc
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Dependencies describes the variables an expression reads.
+type Dependencies struct {
+	// Names holds the root variable names, e.g. user for user.address.city.
+	Names []string
+	// Paths holds the full access paths, e.g. user.address.city or
+	// items[*].price. Indexes that are not literals are written as [*].
+	Paths []string
+	// Writes holds the access paths assigned to, e.g. out.total.
+	Writes []string
+	// Functions holds the names of the functions called, built-ins and
+	// variables alike, and the names of the methods, e.g. trim for
+	// name.trim(). Lambdas bound by let or as parameters are left out.
+	Functions []string
+}
+
+// Variables walks the parsed expression and returns the variables it reads,
+// so callers can prefetch them before evaluation.
+func (e *Expression) Variables() *Dependencies {
+	c := &depCollector{
+		names:  make(map[string]bool),
+		paths:  make(map[string]bool),
+		writes: make(map[string]bool),
+		funcs:  make(map[string]bool),
+		locals: make(map[string]bool),
+	}
+	c.collect(e.Expr)
+
+	return &Dependencies{
+		Names:     sortedKeys(c.names),
+		Paths:     sortedKeys(c.paths),
+		Writes:    sortedKeys(c.writes),
+		Functions: sortedKeys(c.funcs),
+	}
+}
+
+type depCollector struct {
+	names  map[string]bool
+	paths  map[string]bool
+	writes map[string]bool
+	funcs  map[string]bool
+	locals map[string]bool // names bound by the expression itself
+}
+
+func (c *depCollector) collect(expr Expr) {
+	switch ex := expr.(type) {
+	case *IdentExpr, *AccessExpr, *IndexExpr:
+		if root, path, ok := c.path(ex); ok {
+			c.names[root] = true
+			c.paths[path] = true
+		}
+	case *ParenExpr:
+		c.collect(ex.E)
+	case *UnaryExpr:
+		c.collect(ex.E)
+	case *BinaryExpr:
+		c.collect(ex.LE)
+		c.collect(ex.RE)
+	case *LetExpr:
+		c.collect(ex.Value)
+		c.locals[ex.Name.Name] = true
+	case *AssignExpr:
+		c.collect(ex.Value)
+		if ex.Op != OpAssign {
+			c.collect(ex.Target) // += and -= read the target as well
+		}
+		if _, path, ok := c.path(ex.Target); ok {
+			c.writes[path] = true
+		}
+	case *LambdaExpr:
+		shadowed := make(map[string]bool, len(ex.Params))
+		for _, param := range ex.Params {
+			shadowed[param.Name] = c.locals[param.Name]
+			c.locals[param.Name] = true
+		}
+		c.collect(ex.Body)
+		for name, local := range shadowed {
+			c.locals[name] = local
+		}
+	case *UnitExpr:
+		c.collect(ex.X)
+	case *SliceExpr:
+		c.collect(ex.E)
+		c.collect(ex.Lo) // nil bounds collect nothing
+		c.collect(ex.Hi)
+	case *CallExpr:
+		switch fun := ex.Fun.(type) {
+		case *AccessExpr:
+			c.collect(fun.E) // the method name is not a member
+			c.funcs[fun.Access.Name] = true
+		case *IdentExpr:
+			if !c.locals[fun.Name] {
+				c.funcs[fun.Name] = true
+			}
+			if c.locals[fun.Name] || builtins[fun.Name] == nil {
+				c.collect(fun)
+			}
+		default:
+			c.collect(fun)
+		}
+		for _, arg := range ex.Args {
+			c.collect(arg)
+		}
+	case *Program:
+		for _, stmt := range ex.Stmts {
+			c.collect(stmt)
+		}
+	}
+}
+
+// path renders the access path of expr. Expressions found along the way,
+// such as dynamic indexes, are collected as well.
+func (c *depCollector) path(expr Expr) (string, string, bool) {
+	switch ex := expr.(type) {
+	case *IdentExpr:
+		if c.locals[ex.Name] {
+			return "", "", false
+		}
+		return ex.Name, ex.Name, true
+	case *ParenExpr:
+		return c.path(ex.E)
+	case *AccessExpr:
+		root, path, ok := c.path(ex.E)
+		if !ok {
+			return "", "", false
+		}
+		return root, path + "." + ex.Access.Name, true
+	case *IndexExpr:
+		c.collect(ex.Index)
+		root, path, ok := c.path(ex.E)
+		if !ok {
+			return "", "", false
+		}
+		return root, path + "[" + indexPath(ex.Index) + "]", true
+	}
+	c.collect(expr)
+	return "", "", false
+}
+
+func indexPath(index Expr) string {
+	if lit, ok := index.(*LiteralExpr); ok {
+		switch v := lit.Date.(type) {
+		case int:
+			return strconv.Itoa(v)
+		case string:
+			return strconv.Quote(v)
+		}
+	}
+	return "*"
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,459 @@
+package gocalc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// BinaryVersion is the version of the binary encoding written by Encode.
+const BinaryVersion = 1
+
+var binaryMagic = []byte("GCX")
+
+// MaxDecodeDepth bounds the nesting of the nodes read by Decode, so that
+// crafted input cannot exhaust the stack.
+var MaxDecodeDepth = 10000
+
+const (
+	nodeLiteral byte = iota + 1
+	nodeIdent
+	nodeAccess
+	nodeIndex
+	nodeBinary
+	nodeParen
+	nodeUnary
+	nodeLet
+	nodeProgram
+	nodeAssign
+	nodeLambda
+	nodeCall
+	nodeUnit
+	nodeSlice
+)
+
+// Encode returns a compact binary encoding of e: a magic and version
+// header, a pool of interned identifiers and string literals, the nodes
+// with varint-encoded tokens, and a trailing CRC-32 checksum. Source
+// positions and literal spellings are not part of the encoding.
+func Encode(e Expr) ([]byte, error) {
+	enc := &encoder{
+		index: make(map[string]uint64),
+	}
+	if err := enc.expr(e); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(binaryMagic)
+	buf.WriteByte(BinaryVersion)
+	writeUvarint(&buf, uint64(len(enc.pool)))
+	for _, s := range enc.pool {
+		writeUvarint(&buf, uint64(len(s)))
+		buf.WriteString(s)
+	}
+	buf.Write(enc.body.Bytes())
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+	return buf.Bytes(), nil
+}
+
+// Decode decodes and validates an expression encoded by Encode.
+func Decode(data []byte) (Expr, error) {
+	header := len(binaryMagic) + 1
+	if len(data) < header+4 || !bytes.Equal(data[:len(binaryMagic)], binaryMagic) {
+		return nil, errors.New("not an encoded expression")
+	}
+	if v := data[len(binaryMagic)]; v != BinaryVersion {
+		return nil, fmt.Errorf("unsupported expr version[%d]", v)
+	}
+	payload, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	dec := &decoder{r: bytes.NewReader(payload[header:])}
+	n := dec.uvarint()
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		dec.pool = append(dec.pool, dec.readString(dec.uvarint()))
+	}
+	e := dec.expr()
+	if dec.err == nil && dec.r.Len() != 0 {
+		dec.err = errors.New("trailing data")
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	return e, nil
+}
+
+// ------------------------------------------------------------------
+
+type encoder struct {
+	body  bytes.Buffer
+	pool  []string
+	index map[string]uint64
+}
+
+// intern writes the pool index of s, adding s to the pool when needed.
+func (enc *encoder) intern(s string) {
+	idx, find := enc.index[s]
+	if !find {
+		idx = uint64(len(enc.pool))
+		enc.pool = append(enc.pool, s)
+		enc.index[s] = idx
+	}
+	writeUvarint(&enc.body, idx)
+}
+
+func (enc *encoder) expr(e Expr) error {
+	switch ex := e.(type) {
+	case *LiteralExpr:
+		enc.body.WriteByte(nodeLiteral)
+		writeUvarint(&enc.body, uint64(ex.Kind))
+		switch v := ex.Date.(type) {
+		case int:
+			writeVarint(&enc.body, int64(v))
+		case float64:
+			writeUvarint(&enc.body, math.Float64bits(v))
+		case string:
+			enc.intern(v)
+		case bool:
+			if v {
+				enc.body.WriteByte(1)
+			} else {
+				enc.body.WriteByte(0)
+			}
+		case time.Duration:
+			writeVarint(&enc.body, int64(v))
+		case complex128:
+			writeUvarint(&enc.body, math.Float64bits(imag(v)))
+		case rune:
+			writeVarint(&enc.body, int64(v))
+		default:
+			return fmt.Errorf("wrong literal value[%T]", ex.Date)
+		}
+	case *IdentExpr:
+		enc.body.WriteByte(nodeIdent)
+		enc.intern(ex.Name)
+	case *AccessExpr:
+		enc.body.WriteByte(nodeAccess)
+		enc.intern(ex.Access.Name)
+		return enc.expr(ex.E)
+	case *IndexExpr:
+		enc.body.WriteByte(nodeIndex)
+		if err := enc.expr(ex.E); err != nil {
+			return err
+		}
+		return enc.expr(ex.Index)
+	case *BinaryExpr:
+		enc.body.WriteByte(nodeBinary)
+		writeUvarint(&enc.body, uint64(ex.Op))
+		if err := enc.expr(ex.LE); err != nil {
+			return err
+		}
+		return enc.expr(ex.RE)
+	case *ParenExpr:
+		enc.body.WriteByte(nodeParen)
+		return enc.expr(ex.E)
+	case *UnaryExpr:
+		enc.body.WriteByte(nodeUnary)
+		writeUvarint(&enc.body, uint64(ex.Op))
+		return enc.expr(ex.E)
+	case *LetExpr:
+		enc.body.WriteByte(nodeLet)
+		enc.intern(ex.Name.Name)
+		return enc.expr(ex.Value)
+	case *AssignExpr:
+		enc.body.WriteByte(nodeAssign)
+		writeUvarint(&enc.body, uint64(ex.Op))
+		if err := enc.expr(ex.Target); err != nil {
+			return err
+		}
+		return enc.expr(ex.Value)
+	case *LambdaExpr:
+		enc.body.WriteByte(nodeLambda)
+		writeUvarint(&enc.body, uint64(len(ex.Params)))
+		for _, param := range ex.Params {
+			enc.intern(param.Name)
+		}
+		return enc.expr(ex.Body)
+	case *UnitExpr:
+		enc.body.WriteByte(nodeUnit)
+		enc.intern(ex.Unit)
+		return enc.expr(ex.X)
+	case *SliceExpr:
+		// a byte of flags tells which of the bounds follow
+		enc.body.WriteByte(nodeSlice)
+		var bounds byte
+		if ex.Lo != nil {
+			bounds |= 1
+		}
+		if ex.Hi != nil {
+			bounds |= 2
+		}
+		enc.body.WriteByte(bounds)
+		for _, x := range []Expr{ex.E, ex.Lo, ex.Hi} {
+			if x == nil {
+				continue
+			}
+			if err := enc.expr(x); err != nil {
+				return err
+			}
+		}
+	case *CallExpr:
+		enc.body.WriteByte(nodeCall)
+		if err := enc.expr(ex.Fun); err != nil {
+			return err
+		}
+		return enc.list(ex.Args)
+	case *Program:
+		enc.body.WriteByte(nodeProgram)
+		return enc.list(ex.Stmts)
+	default:
+		return fmt.Errorf("unknown express type[%T]", e)
+	}
+	return nil
+}
+
+func (enc *encoder) list(list []Expr) error {
+	writeUvarint(&enc.body, uint64(len(list)))
+	for _, e := range list {
+		if err := enc.expr(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeVarint(buf *bytes.Buffer, v int64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// ------------------------------------------------------------------
+
+// decoder reads nodes written by encoder. The first error sticks and
+// makes every later read return a zero value.
+type decoder struct {
+	r     *bytes.Reader
+	pool  []string
+	depth int
+	err   error
+}
+
+func (dec *decoder) fail(err error) {
+	if dec.err == nil {
+		dec.err = err
+	}
+}
+
+func (dec *decoder) readByte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	b, err := dec.r.ReadByte()
+	if err != nil {
+		dec.fail(errors.New("unexpected end of data"))
+	}
+	return b
+}
+
+func (dec *decoder) uvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		dec.fail(errors.New("malformed varint"))
+	}
+	return v
+}
+
+func (dec *decoder) varint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(dec.r)
+	if err != nil {
+		dec.fail(errors.New("malformed varint"))
+	}
+	return v
+}
+
+func (dec *decoder) readString(n uint64) string {
+	if dec.err != nil {
+		return ""
+	}
+	if n > uint64(dec.r.Len()) {
+		dec.fail(errors.New("unexpected end of data"))
+		return ""
+	}
+	b := make([]byte, n)
+	dec.r.Read(b)
+	return string(b)
+}
+
+func (dec *decoder) str() string {
+	idx := dec.uvarint()
+	if dec.err != nil {
+		return ""
+	}
+	if idx >= uint64(len(dec.pool)) {
+		dec.fail(fmt.Errorf("wrong pool index[%d]", idx))
+		return ""
+	}
+	return dec.pool[idx]
+}
+
+func (dec *decoder) token() Token {
+	tok := Token(dec.uvarint())
+	if tok.String() == "" {
+		dec.fail(fmt.Errorf("unknown token[%d]", tok))
+	}
+	return tok
+}
+
+// count reads the length of a list, each element of which takes at least
+// one byte.
+func (dec *decoder) count() uint64 {
+	n := dec.uvarint()
+	if dec.err == nil && n > uint64(dec.r.Len()) {
+		dec.fail(fmt.Errorf("wrong list length[%d]", n))
+	}
+	return n
+}
+
+func (dec *decoder) list() []Expr {
+	var list []Expr
+	n := dec.count()
+	for i := uint64(0); i < n && dec.err == nil; i++ {
+		list = append(list, dec.expr())
+	}
+	return list
+}
+
+func (dec *decoder) expr() Expr {
+	if dec.err != nil {
+		return nil
+	}
+	dec.depth++
+	defer func() { dec.depth-- }()
+	if MaxDecodeDepth > 0 && dec.depth > MaxDecodeDepth {
+		dec.fail(fmt.Errorf("expression exceeds depth %d", MaxDecodeDepth))
+		return nil
+	}
+
+	switch tag := dec.readByte(); tag {
+	case nodeLiteral:
+		e := &LiteralExpr{Kind: dec.token()}
+		switch e.Kind {
+		case Integer:
+			e.Date = int(dec.varint())
+		case Float:
+			e.Date = math.Float64frombits(dec.uvarint())
+		case String:
+			e.Date = dec.str()
+		case Bool:
+			e.Date = dec.readByte() != 0
+		case Duration:
+			e.Date = time.Duration(dec.varint())
+		case Complex:
+			e.Date = complex(0, math.Float64frombits(dec.uvarint()))
+		case Char:
+			e.Date = rune(dec.varint())
+		default:
+			dec.fail(fmt.Errorf("wrong literal kind[%s]", e.Kind))
+		}
+		return e
+	case nodeIdent:
+		return &IdentExpr{Name: dec.str()}
+	case nodeAccess:
+		name := dec.str()
+		return &AccessExpr{Access: IdentExpr{Name: name}, E: dec.expr()}
+	case nodeIndex:
+		x := dec.expr()
+		return &IndexExpr{E: x, Index: dec.expr()}
+	case nodeBinary:
+		op := dec.token()
+		if dec.err == nil && OpPrecedence(op) == 0 {
+			dec.fail(fmt.Errorf("wrong binary operator[%s]", op))
+		}
+		le := dec.expr()
+		return &BinaryExpr{LE: le, Op: op, RE: dec.expr()}
+	case nodeParen:
+		return &ParenExpr{E: dec.expr()}
+	case nodeUnary:
+		op := dec.token()
+		if dec.err == nil && !isUnaryOp(op) {
+			dec.fail(fmt.Errorf("wrong unary operator[%s]", op))
+		}
+		return &UnaryExpr{Op: op, E: dec.expr()}
+	case nodeLet:
+		name := dec.str()
+		return &LetExpr{Name: IdentExpr{Name: name}, Value: dec.expr()}
+	case nodeAssign:
+		op := dec.token()
+		if dec.err == nil && !isAssignOp(op) {
+			dec.fail(fmt.Errorf("wrong assign operator[%s]", op))
+		}
+		target := dec.expr()
+		if dec.err == nil && !isAssignable(target) {
+			dec.fail(fmt.Errorf("cannot assign to %s", Format(target)))
+		}
+		return &AssignExpr{Target: target, Op: op, Value: dec.expr()}
+	case nodeLambda:
+		lambda := &LambdaExpr{}
+		n := dec.count()
+		if dec.err == nil && n == 0 {
+			dec.fail(errors.New("missing lambda parameters"))
+		}
+		for i := uint64(0); i < n && dec.err == nil; i++ {
+			lambda.Params = append(lambda.Params, IdentExpr{Name: dec.str()})
+		}
+		lambda.Body = dec.expr()
+		return lambda
+	case nodeUnit:
+		unit := dec.str()
+		if _, err := parseUnit(unit); dec.err == nil && err != nil {
+			dec.fail(err)
+		}
+		return &UnitExpr{Unit: unit, X: dec.expr()}
+	case nodeSlice:
+		bounds := dec.readByte()
+		if dec.err == nil && bounds > 3 {
+			dec.fail(fmt.Errorf("wrong slice bounds[%d]", bounds))
+		}
+		slice := &SliceExpr{E: dec.expr()}
+		if bounds&1 != 0 {
+			slice.Lo = dec.expr()
+		}
+		if bounds&2 != 0 {
+			slice.Hi = dec.expr()
+		}
+		return slice
+	case nodeCall:
+		fun := dec.expr()
+		return &CallExpr{Fun: fun, Args: dec.list()}
+	case nodeProgram:
+		stmts := dec.list()
+		if dec.err == nil && len(stmts) == 0 {
+			dec.fail(errors.New("empty program"))
+		}
+		return &Program{Stmts: stmts}
+	default:
+		dec.fail(fmt.Errorf("unknown node tag[%d]", tag))
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package gocalc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// JSONVersion is the version of the JSON encoding written by MarshalExpr.
+const JSONVersion = 1
+
+type jsonDocument struct {
+	Version int       `json:"version"`
+	Expr    *jsonExpr `json:"expr"`
+}
+
+// jsonExpr is the type-tagged JSON form of every node type.
+type jsonExpr struct {
+	Type    string          `json:"type"`
+	Kind    Token           `json:"kind,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Literal string          `json:"literal,omitempty"`
+	Name    string          `json:"name,omitempty"`
+	Op      Token           `json:"op,omitempty"`
+	X       *jsonExpr       `json:"x,omitempty"`
+	Y       *jsonExpr       `json:"y,omitempty"`
+	Index   *jsonExpr       `json:"index,omitempty"`
+	List    []*jsonExpr     `json:"list,omitempty"`
+	Params  []string        `json:"params,omitempty"`
+}
+
+// MarshalExpr returns the versioned JSON encoding of e, which
+// UnmarshalExpr loads back without re-parsing. Source positions are not
+// part of the encoding.
+func MarshalExpr(e Expr) ([]byte, error) {
+	je, err := toJSONExpr(e)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonDocument{Version: JSONVersion, Expr: je})
+}
+
+// UnmarshalExpr decodes and validates an expression encoded by MarshalExpr.
+func UnmarshalExpr(data []byte) (Expr, error) {
+	var doc jsonDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Version != JSONVersion {
+		return nil, fmt.Errorf("unsupported expr version[%d]", doc.Version)
+	}
+	if doc.Expr == nil {
+		return nil, errors.New("missing expr")
+	}
+	return fromJSONExpr(doc.Expr)
+}
+
+func toJSONExpr(e Expr) (*jsonExpr, error) {
+	var err error
+	je := &jsonExpr{}
+
+	switch ex := e.(type) {
+	case *LiteralExpr:
+		je.Type, je.Kind, je.Literal = "literal", ex.Kind, ex.Literal
+		if c, ok := ex.Date.(complex128); ok {
+			je.Value, err = json.Marshal(imag(c))
+		} else {
+			je.Value, err = json.Marshal(ex.Date)
+		}
+	case *IdentExpr:
+		je.Type, je.Name = "ident", ex.Name
+	case *AccessExpr:
+		je.Type, je.Name = "access", ex.Access.Name
+		je.X, err = toJSONExpr(ex.E)
+	case *IndexExpr:
+		je.Type = "index"
+		if je.X, err = toJSONExpr(ex.E); err == nil {
+			je.Index, err = toJSONExpr(ex.Index)
+		}
+	case *BinaryExpr:
+		je.Type, je.Op = "binary", ex.Op
+		if je.X, err = toJSONExpr(ex.LE); err == nil {
+			je.Y, err = toJSONExpr(ex.RE)
+		}
+	case *ParenExpr:
+		je.Type = "paren"
+		je.X, err = toJSONExpr(ex.E)
+	case *UnaryExpr:
+		je.Type, je.Op = "unary", ex.Op
+		je.X, err = toJSONExpr(ex.E)
+	case *LetExpr:
+		je.Type, je.Name = "let", ex.Name.Name
+		je.X, err = toJSONExpr(ex.Value)
+	case *AssignExpr:
+		je.Type, je.Op = "assign", ex.Op
+		if je.X, err = toJSONExpr(ex.Target); err == nil {
+			je.Y, err = toJSONExpr(ex.Value)
+		}
+	case *LambdaExpr:
+		je.Type = "lambda"
+		for _, param := range ex.Params {
+			je.Params = append(je.Params, param.Name)
+		}
+		je.X, err = toJSONExpr(ex.Body)
+	case *UnitExpr:
+		je.Type, je.Name = "unit", ex.Unit
+		je.X, err = toJSONExpr(ex.X)
+	case *SliceExpr:
+		// the bounds are the index and y, left out when missing
+		je.Type = "slice"
+		je.X, err = toJSONExpr(ex.E)
+		if ex.Lo != nil && err == nil {
+			je.Index, err = toJSONExpr(ex.Lo)
+		}
+		if ex.Hi != nil && err == nil {
+			je.Y, err = toJSONExpr(ex.Hi)
+		}
+	case *CallExpr:
+		je.Type = "call"
+		if je.X, err = toJSONExpr(ex.Fun); err == nil {
+			je.List, err = toJSONList(ex.Args)
+		}
+	case *Program:
+		je.Type = "program"
+		je.List, err = toJSONList(ex.Stmts)
+	default:
+		return nil, fmt.Errorf("unknown express type[%T]", e)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return je, nil
+}
+
+func toJSONList(list []Expr) ([]*jsonExpr, error) {
+	var out []*jsonExpr
+	for _, e := range list {
+		je, err := toJSONExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, je)
+	}
+	return out, nil
+}
+
+func fromJSONList(list []*jsonExpr) ([]Expr, error) {
+	var out []Expr
+	for _, je := range list {
+		e, err := fromJSONExpr(je)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func fromJSONExpr(je *jsonExpr) (Expr, error) {
+	if je == nil {
+		return nil, errors.New("missing operand")
+	}
+
+	switch je.Type {
+	case "literal":
+		data, err := literalValue(je.Kind, je.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &LiteralExpr{Kind: je.Kind, Literal: je.Literal, Date: data}, nil
+	case "ident":
+		if je.Name == "" {
+			return nil, errors.New("missing ident name")
+		}
+		return &IdentExpr{Name: je.Name}, nil
+	case "access":
+		if je.Name == "" {
+			return nil, errors.New("missing access name")
+		}
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		return &AccessExpr{E: x, Access: IdentExpr{Name: je.Name}}, nil
+	case "index":
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		index, err := fromJSONExpr(je.Index)
+		if err != nil {
+			return nil, err
+		}
+		return &IndexExpr{E: x, Index: index}, nil
+	case "binary":
+		if OpPrecedence(je.Op) == 0 {
+			return nil, fmt.Errorf("wrong binary operator[%s]", je.Op)
+		}
+		le, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		re, err := fromJSONExpr(je.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryExpr{LE: le, Op: je.Op, RE: re}, nil
+	case "paren":
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		return &ParenExpr{E: x}, nil
+	case "unary":
+		if !isUnaryOp(je.Op) {
+			return nil, fmt.Errorf("wrong unary operator[%s]", je.Op)
+		}
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: je.Op, E: x}, nil
+	case "let":
+		if je.Name == "" {
+			return nil, errors.New("missing let name")
+		}
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		return &LetExpr{Name: IdentExpr{Name: je.Name}, Value: x}, nil
+	case "assign":
+		if !isAssignOp(je.Op) {
+			return nil, fmt.Errorf("wrong assign operator[%s]", je.Op)
+		}
+		target, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		if !isAssignable(target) {
+			return nil, fmt.Errorf("cannot assign to %s", Format(target))
+		}
+		value, err := fromJSONExpr(je.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &AssignExpr{Target: target, Op: je.Op, Value: value}, nil
+	case "lambda":
+		if len(je.Params) == 0 {
+			return nil, errors.New("missing lambda parameters")
+		}
+		lambda := &LambdaExpr{}
+		for _, name := range je.Params {
+			if name == "" {
+				return nil, errors.New("missing lambda parameter name")
+			}
+			lambda.Params = append(lambda.Params, IdentExpr{Name: name})
+		}
+		body, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		lambda.Body = body
+		return lambda, nil
+	case "unit":
+		if _, err := parseUnit(je.Name); err != nil {
+			return nil, err
+		}
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		return &UnitExpr{X: x, Unit: je.Name}, nil
+	case "slice":
+		x, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		slice := &SliceExpr{E: x}
+		if je.Index != nil {
+			if slice.Lo, err = fromJSONExpr(je.Index); err != nil {
+				return nil, err
+			}
+		}
+		if je.Y != nil {
+			if slice.Hi, err = fromJSONExpr(je.Y); err != nil {
+				return nil, err
+			}
+		}
+		return slice, nil
+	case "call":
+		fun, err := fromJSONExpr(je.X)
+		if err != nil {
+			return nil, err
+		}
+		args, err := fromJSONList(je.List)
+		if err != nil {
+			return nil, err
+		}
+		return &CallExpr{Fun: fun, Args: args}, nil
+	case "program":
+		if len(je.List) == 0 {
+			return nil, errors.New("empty program")
+		}
+		stmts, err := fromJSONList(je.List)
+		if err != nil {
+			return nil, err
+		}
+		return &Program{Stmts: stmts}, nil
+	}
+	return nil, fmt.Errorf("unknown express type[%s]", je.Type)
+}
+
+// literalValue decodes the value of a literal, checking it against kind.
+func literalValue(kind Token, raw json.RawMessage) (interface{}, error) {
+	var err error
+	switch kind {
+	case Integer:
+		var v int
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	case Float:
+		var v float64
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	case String:
+		var v string
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	case Bool:
+		var v bool
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	case Duration:
+		var v int64
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return time.Duration(v), nil
+		}
+	case Char:
+		var v rune
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return v, nil
+		}
+	case Complex:
+		// the imaginary part, as literals are imaginary numbers
+		var v float64
+		if err = json.Unmarshal(raw, &v); err == nil {
+			return complex(0, v), nil
+		}
+	default:
+		return nil, fmt.Errorf("wrong literal kind[%s]", kind)
+	}
+	return nil, fmt.Errorf("wrong %s literal: %v", kind, err)
+}
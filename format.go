@@ -0,0 +1,246 @@
+package gocalc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format returns the canonical source text of e. Parentheses are emitted
+// only where OpPrecedence requires them, so redundant ParenExpr nodes are
+// dropped: Parse(Format(e)) yields e up to ParenExpr nodes, and formatting
+// the result again returns the same text.
+func Format(e Expr) string {
+	return FormatWithComments(e, nil)
+}
+
+// FormatWithComments is like Format but also prints the comments of cmap
+// next to the nodes they are attached to.
+func FormatWithComments(e Expr, cmap CommentMap) string {
+	p := &printer{comments: cmap}
+	p.expr(e)
+	return p.b.String()
+}
+
+type printer struct {
+	b        strings.Builder
+	comments CommentMap
+	newline  bool // a line comment was printed and the line must end
+}
+
+// text writes s, ending the line of a line comment first.
+func (p *printer) text(s string) {
+	if p.newline {
+		p.b.WriteByte('\n')
+		s = strings.TrimPrefix(s, " ")
+		p.newline = false
+	}
+	p.b.WriteString(s)
+}
+
+// comment prints the comments attached to e that lie before e, if leading
+// is set, or after it.
+func (p *printer) comment(e Expr, leading bool) {
+	for _, c := range p.comments[e] {
+		if (c.Pos.Offset < e.Pos().Offset) != leading {
+			continue
+		}
+		if !leading {
+			p.text(" ")
+		}
+		p.text(c.Literal)
+		if strings.HasPrefix(c.Literal, "//") {
+			p.newline = true
+		} else if leading {
+			p.text(" ")
+		}
+	}
+}
+
+// unaryPrecedence binds tighter than any binary operator but **.
+const unaryPrecedence Precedence = 2
+
+// lambdaPrecedence is looser than any binary operator, as the body of a
+// lambda extends as far as possible.
+var lambdaPrecedence = argPrecedence + 1
+
+// precedenceOf returns the precedence of the operator at the root of e,
+// or 0 for operands that never need parentheses.
+func precedenceOf(e Expr) Precedence {
+	switch ex := e.(type) {
+	case *ParenExpr:
+		return precedenceOf(ex.E)
+	case *BinaryExpr:
+		return OpPrecedence(ex.Op)
+	case *UnaryExpr:
+		return unaryPrecedence
+	case *LambdaExpr:
+		return lambdaPrecedence
+	}
+	return 0
+}
+
+func (p *printer) expr(e Expr) {
+	p.comment(e, true)
+	switch ex := e.(type) {
+	case *LiteralExpr:
+		p.text(formatLiteral(ex))
+	case *IdentExpr:
+		p.text(ex.Name)
+	case *ParenExpr:
+		p.expr(ex.E)
+	case *AccessExpr:
+		p.operand(ex.E)
+		p.text(".")
+		p.comment(&ex.Access, true)
+		p.text(ex.Access.Name)
+		p.comment(&ex.Access, false)
+	case *IndexExpr:
+		p.operand(ex.E)
+		p.text("[")
+		p.expr(ex.Index)
+		p.text("]")
+	case *SliceExpr:
+		p.operand(ex.E)
+		p.text("[")
+		if ex.Lo != nil {
+			p.expr(ex.Lo)
+		}
+		p.text(":")
+		if ex.Hi != nil {
+			p.expr(ex.Hi)
+		}
+		p.text("]")
+	case *UnaryExpr:
+		p.text(ex.Op.String())
+		prec := precedenceOf(ex.E)
+		if _, unary := unparen(ex.E).(*UnaryExpr); unary {
+			prec = 0 // --x
+		}
+		// ! and ~ are binary operators too: !(0 ! 0)
+		p.paren(ex.E, prec >= unaryPrecedence)
+	case *BinaryExpr:
+		prec := OpPrecedence(ex.Op)
+		// operators are left-associative, but for **
+		right := ex.Op == OpPower
+		p.paren(ex.LE, precedenceOf(ex.LE) > prec || right && precedenceOf(ex.LE) == prec)
+		if ex.Op != OpSeparate {
+			p.text(" ")
+		}
+		p.text(ex.Op.String() + " ")
+		rprec := precedenceOf(ex.RE)
+		if _, unary := unparen(ex.RE).(*UnaryExpr); unary && right {
+			rprec = prec // 2 ** -1
+		}
+		p.paren(ex.RE, rprec > prec || !right && rprec == prec)
+	case *LetExpr:
+		p.text(LET + " ")
+		p.comment(&ex.Name, true)
+		p.text(ex.Name.Name)
+		p.comment(&ex.Name, false)
+		p.text(" = ")
+		p.expr(ex.Value)
+	case *AssignExpr:
+		p.expr(ex.Target)
+		p.text(" " + ex.Op.String() + " ")
+		p.expr(ex.Value)
+	case *LambdaExpr:
+		paren := len(ex.Params) != 1
+		if paren {
+			p.text("(")
+		}
+		for i := range ex.Params {
+			if i > 0 {
+				p.text(", ")
+			}
+			p.comment(&ex.Params[i], true)
+			p.text(ex.Params[i].Name)
+			p.comment(&ex.Params[i], false)
+		}
+		if paren {
+			p.text(")")
+		}
+		p.text(" => ")
+		p.paren(ex.Body, precedenceOf(ex.Body) == argPrecedence)
+	case *UnitExpr:
+		p.expr(ex.X)
+		p.text(" " + ex.Unit)
+	case *CallExpr:
+		p.operand(ex.Fun)
+		p.text("(")
+		for i, arg := range ex.Args {
+			if i > 0 {
+				p.text(", ")
+			}
+			p.paren(arg, precedenceOf(arg) == argPrecedence)
+		}
+		p.text(")")
+	case *Program:
+		for i, stmt := range ex.Stmts {
+			if i > 0 {
+				p.text("; ")
+			}
+			p.expr(stmt)
+		}
+	}
+	p.comment(e, false)
+}
+
+// operand formats the operand of an access or index expression.
+func (p *printer) operand(e Expr) {
+	paren := precedenceOf(e) > 0
+	if lit, ok := unparen(e).(*LiteralExpr); ok && (lit.Kind == Integer || lit.Kind == Float) {
+		paren = true // 1.a would scan as a malformed float
+	}
+	p.paren(e, paren)
+}
+
+func (p *printer) paren(e Expr, paren bool) {
+	if paren {
+		p.text("(")
+	}
+	p.expr(e)
+	if paren {
+		p.text(")")
+	}
+}
+
+func formatLiteral(e *LiteralExpr) string {
+	switch v := e.Date.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return formatFloat(v, 64)
+	case float32:
+		return formatFloat(float64(v), 32)
+	case string:
+		return strconv.Quote(v)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return v.String()
+	case complex128:
+		return strconv.FormatFloat(imag(v), 'f', -1, 64) + "i"
+	case rune:
+		return strconv.QuoteRune(v)
+	}
+	return e.Literal
+}
+
+func unparen(e Expr) Expr {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.E
+	}
+}
+
+func formatFloat(v float64, bitSize int) string {
+	s := strconv.FormatFloat(v, 'f', -1, bitSize)
+	if !strings.ContainsRune(s, '.') {
+		s += ".0"
+	}
+	return s
+}
@@ -0,0 +1,197 @@
+package gocalc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// seedExprs is the seed corpus shared by the fuzz targets, taken from the
+// kind of rules the package is used for.
+var seedExprs = []string{
+	`a + 1`,
+	`(a + b) * -c`,
+	`price * qty >= 100 && price * qty < 1000`,
+	`user.age >= 18 || user.vip == true`,
+	`order.items[0].price * 1.2`,
+	`m["key"] + "suffix"`,
+	`!(a > b) && (c <= d || e != f)`,
+	`x % 7 == 0 && x >> 2 < 10`,
+	`"a\"b\n" + 'c'`,
+	`((((x))))`,
+	`---x`,
+	`1 / 0`,
+	`1.5 + 2`,
+	`a.b[c.d]`,
+	`1 +`,
+	`let t = a * b; let t = t + 1; t > c;`,
+	"/* fee */ a * 2 // rounded\n + 1",
+	`sum(map(filter(items, x => x > 1), x -> x * 2))`,
+	`now() - parseTime("2024-03-01T09:30:00Z") > 24h && 1h30m / 2 < 50m`,
+	`to(a * 1.5 kg*m/s^2 + 2 N, "kN") < 1 kN`,
+	`round(money(price, "EUR") * qty / 3, "halfUp") > 12.50 EUR`,
+	`abs(a + 2.5i) ** 2 - real(conj(1i * b)) != 2 ** 3 ** 2`,
+	`items[-1] + sum(items[-2:]) + len(items[:-1]) - len(m["key"][-3:])`,
+	`m["key"][1] + 'é' == "alué".upper().fold()[1] + m["key"][len(m["key"]) - 1]`,
+	`m["key"][1:len(m["key"]) - 1] + 'é' == "alué".upper().fold()[:4]`,
+	`!(0!0)`,
+	`~(1~2)`,
+}
+
+// fuzzParams are the variables the evaluated seeds refer to.
+var fuzzParams = map[string]interface{}{
+	"a": 3, "b": 4, "c": 5, "d": 6, "e": true, "f": false, "x": 42,
+	"price": 12.5, "qty": 10,
+	"user":  map[string]interface{}{"age": 20, "vip": false},
+	"order": map[string]interface{}{"items": []map[string]interface{}{{"price": 2}}},
+	"m":     map[string]string{"key": "value"},
+	"items": []int{1, 2, 3},
+}
+
+var fuzzParseOptions = ParseOptions{MaxSourceLen: 4096, MaxDepth: 32, MaxNodes: 256, MaxLiteralLen: 64}
+
+func FuzzScan(f *testing.F) {
+	for _, seed := range seedExprs {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		s := NewScanner(src)
+		// every call consumes at least one rune until EOF
+		for i := 0; ; i++ {
+			if i > utf8.RuneCountInString(src)+1 {
+				t.Fatalf("scanner does not terminate on %q", src)
+			}
+			if tok, _ := s.scan(); tok == EOF {
+				break
+			}
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range seedExprs {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		e, err := ParseWithOptions(src, fuzzParseOptions)
+		if err != nil {
+			return
+		}
+
+		formatted := Format(e)
+		again, err := Parse(formatted)
+		if err != nil {
+			t.Fatalf("%q formats as %q, which does not parse: %v", src, formatted, err)
+		}
+		if !reflect.DeepEqual(normalize(e), normalize(again)) {
+			t.Fatalf("%q formats as %q, which parses to a different tree", src, formatted)
+		}
+		if Format(again) != formatted {
+			t.Fatalf("formatting %q is not stable: %q", formatted, Format(again))
+		}
+
+		e, comments, _ := ParseWithComments(src, fuzzParseOptions)
+		formatted = FormatWithComments(e, NewCommentMap(e, comments))
+		again, kept, err := ParseWithComments(formatted, DefaultParseOptions)
+		if err != nil {
+			t.Fatalf("%q formats as %q, which does not parse: %v", src, formatted, err)
+		}
+		if !reflect.DeepEqual(normalize(e), normalize(again)) {
+			t.Fatalf("%q formats as %q, which parses to a different tree", src, formatted)
+		}
+		if len(kept) != len(comments) {
+			t.Fatalf("%q formats as %q, which has %d comments, want %d", src, formatted, len(kept), len(comments))
+		}
+	})
+}
+
+func FuzzCalc(f *testing.F) {
+	for _, seed := range seedExprs {
+		f.Add(seed)
+	}
+	now := time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)
+	opts := &EvalOptions{
+		MaxSteps: 1000, MaxDepth: 64, MaxStringLen: 1024, MaxCollectionSize: 16,
+		Now: func() time.Time { return now },
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		e, err := ParseWithOptions(src, fuzzParseOptions)
+		if err != nil {
+			return
+		}
+		want := fuzzEval(e, opts)
+
+		data, err := MarshalExpr(e)
+		if err != nil {
+			t.Fatalf("%q: marshal: %v", src, err)
+		}
+		loaded, err := UnmarshalExpr(data)
+		if err != nil {
+			t.Fatalf("%q: unmarshal: %v", src, err)
+		}
+		if got := fuzzEval(loaded, opts); got != want {
+			t.Fatalf("%q: json form evaluates to %s, want %s", src, got, want)
+		}
+
+		data, err = Encode(e)
+		if err != nil {
+			t.Fatalf("%q: encode: %v", src, err)
+		}
+		decoded, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%q: decode: %v", src, err)
+		}
+		if got := fuzzEval(decoded, opts); got != want {
+			t.Fatalf("%q: binary form evaluates to %s, want %s", src, got, want)
+		}
+	})
+}
+
+// fuzzEval evaluates e and describes the outcome, ignoring error positions
+// which the serialized forms do not keep.
+func fuzzEval(e Expr, opts *EvalOptions) string {
+	result, err := (&Expression{Expr: e}).EvalContext(context.Background(), fuzzParams, opts)
+	if err != nil {
+		if perr, ok := err.(*Error); ok {
+			err = perr.Err
+		}
+		return "error: " + err.Error()
+	}
+	if result.kind == Func {
+		return "FUNC" // closures differ in identity only
+	}
+	return fmt.Sprintf("%s %v", result.kind, result.data)
+}
+
+func TestParseLimits(t *testing.T) {
+	cases := []struct {
+		src  string
+		opts ParseOptions
+	}{
+		{strings.Repeat("(", 100000) + "x" + strings.Repeat(")", 100000), DefaultParseOptions},
+		{strings.Repeat("-", 100000) + "x", DefaultParseOptions},
+		{strings.Repeat("a[", 100000) + "0" + strings.Repeat("]", 100000), DefaultParseOptions},
+		{"1" + strings.Repeat("+1", 3000000), DefaultParseOptions},
+		{"a" + strings.Repeat(".b", 100000) + strings.Repeat("()", 100000), DefaultParseOptions},
+		{`a * b + c`, ParseOptions{MaxDepth: 2}},
+		{`a + b`, ParseOptions{MaxSourceLen: 3}},
+		{`a + b + c`, ParseOptions{MaxNodes: 4}},
+		{`"abcdef"`, ParseOptions{MaxLiteralLen: 5}},
+	}
+	for _, c := range cases {
+		if _, err := ParseWithOptions(c.src, c.opts); err == nil {
+			t.Errorf("%.20s: expected a limit error", c.src)
+		}
+	}
+
+	if _, err := ParseWithOptions(`a + b + c`, ParseOptions{MaxNodes: 5}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ParseWithOptions(`a * b + c`, ParseOptions{MaxDepth: 3}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/zyldgd/go-calc
 
-go 1.12
+go 1.18
 
-require github.com/Knetic/govaluate v3.0.0+incompatible // indirect
+require (
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
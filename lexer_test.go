@@ -47,9 +47,13 @@ func TestScanString(t *testing.T) {
 }
 
 func TestCalc(t *testing.T) {
-	expr := NewExpression("'1' > 321")
+	// a character is not a number
+	if result := NewExpression("'1' > 321").Calc(nil); result != nil {
+		t.Errorf("got %v, want an error", result.data)
+	}
+	expr := NewExpression("'1' > '0'")
 	result := expr.Calc(map[string]interface{}{"a": 89.9, "b": 2})
-	res, err := result.Int()
+	res, err := result.Bool()
 
 	fmt.Printf("result:%+v err:%+v\n", res, err)
 }
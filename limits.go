@@ -0,0 +1,152 @@
+package gocalc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// EvalOptions configures a single evaluation. A zero limit means no limit.
+type EvalOptions struct {
+	// MaxSteps bounds the number of nodes evaluated.
+	MaxSteps int
+	// MaxDepth bounds the nesting depth of the nodes being evaluated.
+	MaxDepth int
+	// MaxStringLen bounds the length in bytes of strings produced by +.
+	MaxStringLen int
+	// MaxCollectionSize bounds the length of slices, arrays and maps.
+	MaxCollectionSize int
+	// AllowMethods lists the exported Go methods that expressions may call
+	// on struct values, as "Type.Method" with the unqualified name of the
+	// struct type, such as "User.FullName".
+	AllowMethods []string
+	// Now returns the current time for now(), time.Now if nil. Tests can
+	// fix it to make time-dependent rules reproducible.
+	Now func() time.Time
+	// Rates converts amounts of money between currencies. Without it,
+	// combining amounts in different currencies is an error.
+	Rates RateResolver
+	// Normalization is the Unicode normalization form strings are brought
+	// to before they are compared. Without it, "\u00e9" and "e\u0301"
+	// differ.
+	Normalization Normalization
+	// FoldCase compares strings case-insensitively, under full Unicode
+	// case folding.
+	FoldCase bool
+}
+
+// checkInterval is the number of steps between two context checks.
+const checkInterval = 64
+
+// StepLimitError is returned when an evaluation exceeds EvalOptions.MaxSteps.
+type StepLimitError struct {
+	Limit int
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("evaluation exceeds %d steps", e.Limit)
+}
+
+// DepthLimitError is returned when an evaluation exceeds EvalOptions.MaxDepth.
+type DepthLimitError struct {
+	Limit int
+}
+
+func (e *DepthLimitError) Error() string {
+	return fmt.Sprintf("evaluation exceeds depth %d", e.Limit)
+}
+
+// StringLimitError is returned when + would produce a string longer than
+// EvalOptions.MaxStringLen.
+type StringLimitError struct {
+	Limit int
+	Len   int
+}
+
+func (e *StringLimitError) Error() string {
+	return fmt.Sprintf("string length %d exceeds %d", e.Len, e.Limit)
+}
+
+// CollectionLimitError is returned when a collection value is larger than
+// EvalOptions.MaxCollectionSize.
+type CollectionLimitError struct {
+	Limit int
+	Len   int
+}
+
+func (e *CollectionLimitError) Error() string {
+	return fmt.Sprintf("collection size %d exceeds %d", e.Len, e.Limit)
+}
+
+// ------------------------------------------------------------------
+
+// EvalContext evaluates the expression with v as the root scope, as
+// CalcWith does, and returns the evaluation error instead of printing it.
+// The evaluation stops when ctx is done or when a limit of opts, which may
+// be nil, is exceeded.
+func (e *Expression) EvalContext(ctx context.Context, v interface{}, opts *EvalOptions) (*Result, error) {
+	resolver, err := newResolver(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{
+		ctx:      ctx,
+		resolver: resolver,
+	}
+	if opts != nil {
+		ev.opts = *opts
+	}
+	return ev.calcExpr(e.Expr)
+}
+
+// enter accounts for one more node being evaluated.
+func (e *evaluator) enter() error {
+	e.steps++
+	e.depth++
+	if e.opts.MaxSteps > 0 && e.steps > e.opts.MaxSteps {
+		return &StepLimitError{Limit: e.opts.MaxSteps}
+	}
+	if e.opts.MaxDepth > 0 && e.depth > e.opts.MaxDepth {
+		return &DepthLimitError{Limit: e.opts.MaxDepth}
+	}
+	// the first step too, so that a canceled context evaluates nothing
+	if e.ctx != nil && (e.steps == 1 || e.steps%checkInterval == 0) {
+		select {
+		case <-e.ctx.Done():
+			return e.ctx.Err()
+		default:
+		}
+	}
+	return nil
+}
+
+func (e *evaluator) leave() {
+	e.depth--
+}
+
+func (e *evaluator) checkString(n int) error {
+	if e.opts.MaxStringLen > 0 && n > e.opts.MaxStringLen {
+		return &StringLimitError{Limit: e.opts.MaxStringLen, Len: n}
+	}
+	return nil
+}
+
+func (e *evaluator) checkCollection(result *Result) error {
+	if e.opts.MaxCollectionSize <= 0 || result.kind != Object {
+		return nil
+	}
+
+	v := reflect.ValueOf(result.data)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if v.Len() > e.opts.MaxCollectionSize {
+			return &CollectionLimitError{Limit: e.opts.MaxCollectionSize, Len: v.Len()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MethodFunc implements a method registered with RegisterMethod. It
+// receives the value the method is called on and the evaluated arguments
+// as Go values, and returns a value that is converted as variables are.
+type MethodFunc func(recv interface{}, args []interface{}) (interface{}, error)
+
+// methods are the methods of each Result kind, called as recv.name(args)
+// with the receiver as the first argument. The built-ins are methods of
+// every kind as well: items.filter(x => x > 1), "abc".len().
+var (
+	methodsMu sync.RWMutex
+	methods   map[Token]map[string]builtin
+)
+
+func init() {
+	methods = map[Token]map[string]builtin{
+		String: {
+			"upper":      stringMethod("upper", upper),
+			"lower":      stringMethod("lower", lower),
+			"fold":       stringMethod("fold", fold),
+			"trim":       stringMethod("trim", strings.TrimSpace),
+			"equalFold":  builtinEqualFold,
+			"contains":   stringTest("contains", strings.Contains),
+			"startsWith": stringTest("startsWith", strings.HasPrefix),
+			"endsWith":   stringTest("endsWith", strings.HasSuffix),
+		},
+		Time: {
+			"year":    timeMethod("year", func(t time.Time) *Result { return intResult(t.Year()) }),
+			"month":   timeMethod("month", func(t time.Time) *Result { return intResult(int(t.Month())) }),
+			"day":     timeMethod("day", func(t time.Time) *Result { return intResult(t.Day()) }),
+			"hour":    timeMethod("hour", func(t time.Time) *Result { return intResult(t.Hour()) }),
+			"minute":  timeMethod("minute", func(t time.Time) *Result { return intResult(t.Minute()) }),
+			"second":  timeMethod("second", func(t time.Time) *Result { return intResult(t.Second()) }),
+			"weekday": timeMethod("weekday", func(t time.Time) *Result { return &Result{kind: String, data: t.Weekday().String()} }),
+			"unix":    timeMethod("unix", func(t time.Time) *Result { return intResult(int(t.Unix())) }),
+		},
+		Quantity: {
+			"value": quantityMethod("value", func(m Measure) *Result { return floatResult(m.Value) }),
+			"unit":  quantityMethod("unit", func(m Measure) *Result { return &Result{kind: String, data: m.Unit} }),
+		},
+		Money: {
+			"amount":   moneyMethod("amount", func(a Amount) *Result { f, _ := a.Value.Float64(); return floatResult(f) }),
+			"currency": moneyMethod("currency", func(a Amount) *Result { return &Result{kind: String, data: a.Currency} }),
+		},
+		Duration: {
+			"hours":        durationMethod("hours", func(d time.Duration) *Result { return floatResult(d.Hours()) }),
+			"minutes":      durationMethod("minutes", func(d time.Duration) *Result { return floatResult(d.Minutes()) }),
+			"seconds":      durationMethod("seconds", func(d time.Duration) *Result { return floatResult(d.Seconds()) }),
+			"milliseconds": durationMethod("milliseconds", func(d time.Duration) *Result { return intResult(int(d / time.Millisecond)) }),
+		},
+	}
+}
+
+// RegisterMethod makes fn callable as the method name of the values of
+// kind, replacing any method of that name. It is safe to call while
+// expressions are evaluated.
+func RegisterMethod(kind Token, name string, fn MethodFunc) {
+	methodsMu.Lock()
+	defer methodsMu.Unlock()
+	if methods[kind] == nil {
+		methods[kind] = make(map[string]builtin)
+	}
+	methods[kind][name] = func(e *evaluator, args []*Result) (*Result, error) {
+		vals := make([]interface{}, len(args)-1)
+		for i, arg := range args[1:] {
+			vals[i] = arg.data
+		}
+		val, err := fn(args[0].data, vals)
+		if err != nil {
+			return nil, err
+		}
+		return e.value(val)
+	}
+}
+
+func lookupMethod(kind Token, name string) builtin {
+	methodsMu.RLock()
+	fn := methods[kind][name]
+	methodsMu.RUnlock()
+	if fn == nil {
+		fn = builtins[name]
+	}
+	return fn
+}
+
+// ------------------------------------------------------------------
+
+// calcMethodCall calls the method named by fun on the value of fun.E: a
+// method registered for the kind of the value, a built-in or, for an
+// Object, a Go method allowed by EvalOptions.AllowMethods.
+func (e *evaluator) calcMethodCall(fun *AccessExpr, argExprs []Expr) (*Result, error) {
+	calc := e.calcExpr
+	if fun.Access.Name == "money" {
+		calc = e.calcAmount
+	}
+	recv, err := calc(fun.E)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]*Result, len(argExprs)+1)
+	args[0] = recv
+	for i, arg := range argExprs {
+		if args[i+1], err = e.calcExpr(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	name := fun.Access.Name
+	if fn := lookupMethod(recv.kind, name); fn != nil {
+		return fn(e, args)
+	}
+	if recv.kind == Object {
+		if m, ok := e.goMethod(recv.data, name); ok {
+			return e.callGoMethod(m, args[1:])
+		}
+	}
+	return nil, fmt.Errorf("undefined method[%v.%s]", recv.kind, name)
+}
+
+// goMethod returns the exported method name of val if the allow-list of
+// the evaluation lists it. Methods with a pointer receiver are found on
+// struct values too, through a copy.
+func (e *evaluator) goMethod(val interface{}, name string) (reflect.Value, bool) {
+	v := reflect.ValueOf(val)
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if !e.methodAllowed(t.Name() + "." + name) {
+		return reflect.Value{}, false
+	}
+
+	if m := v.MethodByName(name); m.IsValid() {
+		return m, true
+	}
+	if v.Kind() != reflect.Ptr {
+		p := reflect.New(t)
+		p.Elem().Set(v)
+		if m := p.MethodByName(name); m.IsValid() {
+			return m, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func (e *evaluator) methodAllowed(name string) bool {
+	for _, allowed := range e.opts.AllowMethods {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// callGoMethod calls m with args converted to its parameter types. The
+// method returns a value, optionally followed by an error.
+func (e *evaluator) callGoMethod(m reflect.Value, args []*Result) (*Result, error) {
+	mt := m.Type()
+	if mt.IsVariadic() {
+		return nil, errors.New("variadic methods are not supported")
+	}
+	if len(args) != mt.NumIn() {
+		return nil, fmt.Errorf("wrong argument count[%d], want %d", len(args), mt.NumIn())
+	}
+	errorType := reflect.TypeOf((*error)(nil)).Elem()
+	switch {
+	case mt.NumOut() == 1:
+	case mt.NumOut() == 2 && mt.Out(1) == errorType:
+	default:
+		return nil, fmt.Errorf("wrong method signature[%s]", mt)
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		v, err := convertValue(arg.data, mt.In(i))
+		if err != nil {
+			return nil, err
+		}
+		in[i] = v
+	}
+
+	out := m.Call(in)
+	if len(out) == 2 && !out[1].IsNil() {
+		return nil, out[1].Interface().(error)
+	}
+	return e.value(out[0].Interface())
+}
+
+// ------------------------------------------------------------------
+
+func stringMethod(name string, f func(string) string) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		return &Result{kind: String, data: f(args[0].data.(string))}, nil
+	}
+}
+
+// stringTest returns a method testing a string against another, both as
+// they are compared, see EvalOptions.Normalization and FoldCase.
+func stringTest(name string, f func(s, substr string) bool) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 2, 2); err != nil {
+			return nil, err
+		}
+		substr, ok := args[1].data.(string)
+		if args[1].kind != String || !ok {
+			return nil, fmt.Errorf("%s: wrong argument type[%v]", name, args[1].kind)
+		}
+		return &Result{kind: Bool, data: f(e.collate(args[0].data.(string)), e.collate(substr))}, nil
+	}
+}
@@ -0,0 +1,336 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"sync"
+)
+
+// Amount is the value of a Money result: an exact decimal amount in an ISO
+// 4217 currency. Value must not be modified.
+type Amount struct {
+	Value    *big.Rat
+	Currency string
+}
+
+// String formats the amount with the minor units of its currency, rounding
+// half to even.
+func (a Amount) String() string {
+	digits, _ := currencyDigits(a.Currency)
+	return roundRat(a.Value, digits, "halfEven").FloatString(digits) + " " + a.Currency
+}
+
+// RateResolver supplies the exchange rates used to combine amounts in
+// different currencies, see EvalOptions.Rates.
+type RateResolver interface {
+	// Rate returns the price of one unit of from in to.
+	Rate(from, to string) (*big.Rat, error)
+}
+
+// RateFunc adapts an ordinary function to a RateResolver.
+type RateFunc func(from, to string) (*big.Rat, error)
+
+func (f RateFunc) Rate(from, to string) (*big.Rat, error) {
+	return f(from, to)
+}
+
+var (
+	currenciesMu sync.RWMutex
+	// currencies maps the ISO 4217 codes to their number of minor units.
+	currencies = map[string]int{
+		"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0,
+		"CNY": 2, "CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2,
+		"IDR": 2, "ILS": 2, "INR": 2, "ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0,
+		"KWD": 3, "MXN": 2, "NOK": 2, "NZD": 2, "OMR": 3, "PLN": 2, "RUB": 2,
+		"SAR": 2, "SEK": 2, "SGD": 2, "THB": 2, "TND": 3, "TRY": 2, "TWD": 2,
+		"UAH": 2, "USD": 2, "VND": 0, "ZAR": 2,
+	}
+)
+
+// RegisterCurrency adds the currency code, or changes its number of minor
+// units, the decimal places amounts in it are rounded to. It is safe to
+// call while expressions are evaluated.
+func RegisterCurrency(code string, digits int) error {
+	if len(code) != 3 || !isUpper(code) {
+		return fmt.Errorf("wrong currency code[%s]", code)
+	}
+	if digits < 0 || digits > 8 {
+		return fmt.Errorf("wrong currency digits[%d]", digits)
+	}
+	currenciesMu.Lock()
+	defer currenciesMu.Unlock()
+	currencies[code] = digits
+	return nil
+}
+
+func currencyDigits(code string) (int, bool) {
+	currenciesMu.RLock()
+	defer currenciesMu.RUnlock()
+	digits, ok := currencies[code]
+	return digits, ok
+}
+
+// isDecimalText reports whether s is a decimal number such as -12.50,
+// without the fractions and exponents big.Rat would accept as well.
+func isDecimalText(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	digits, dot := 0, false
+	for _, c := range s {
+		switch {
+		case IsDecimal(c):
+			digits++
+		case c == '.' && !dot:
+			dot = true
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
+
+func isUpper(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// ------------------------------------------------------------------
+
+// calcAmount evaluates the amount of money expr. A Float literal or a
+// float64 variable is kept as a float64, whose shortest decimal is exact
+// where that of a Float would not be: 1234567.89 is a Float 1234567.9.
+func (e *evaluator) calcAmount(expr Expr) (*Result, error) {
+	switch ex := expr.(type) {
+	case *LiteralExpr:
+		if v, ok := ex.Date.(float64); ok {
+			return &Result{kind: Float, data: v}, nil
+		}
+	case *UnaryExpr:
+		if lit, ok := ex.E.(*LiteralExpr); ok && ex.Op == OpMinus {
+			if v, ok := lit.Date.(float64); ok {
+				return &Result{kind: Float, data: -v}, nil
+			}
+		}
+	case *IdentExpr:
+		if _, local := e.scope.lookup(ex.Name); local {
+			break
+		}
+		val, find, err := e.resolver.Resolve(ex.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !find {
+			return nil, fmt.Errorf("undefined variable[%s]", ex.Name)
+		}
+		if v, ok := val.(float64); ok {
+			return &Result{kind: Float, data: v}, nil
+		}
+		return e.value(val)
+	}
+	return e.calcExpr(expr)
+}
+
+// newMoney returns the amount x, an Integer, a Float or a decimal String,
+// in currency.
+func newMoney(x *Result, currency string) (*Result, error) {
+	if _, ok := currencyDigits(currency); !ok {
+		return nil, fmt.Errorf("unknown currency[%s]", currency)
+	}
+	v := new(big.Rat)
+	switch d := x.data.(type) {
+	case int:
+		v.SetInt64(int64(d))
+	case float32:
+		// the shortest decimal of the float, so that 0.1 stays 0.1
+		v.SetString(strconv.FormatFloat(float64(d), 'f', -1, 32))
+	case float64:
+		if math.IsInf(d, 0) || math.IsNaN(d) {
+			return nil, fmt.Errorf("wrong amount[%v]", d)
+		}
+		v.SetString(strconv.FormatFloat(d, 'f', -1, 64))
+	case string:
+		if !isDecimalText(d) || x.kind != String {
+			return nil, fmt.Errorf("wrong amount[%s]", d)
+		}
+		v.SetString(d)
+	default:
+		return nil, fmt.Errorf("wrong amount type[%v]", x.kind)
+	}
+	return &Result{kind: Money, data: Amount{Value: v, Currency: currency}}, nil
+}
+
+// convertMoney returns a in currency, at the rate of EvalOptions.Rates.
+func (e *evaluator) convertMoney(a Amount, currency string) (Amount, error) {
+	if a.Currency == currency {
+		return a, nil
+	}
+	if _, ok := currencyDigits(currency); !ok {
+		return Amount{}, fmt.Errorf("unknown currency[%s]", currency)
+	}
+	if e.opts.Rates == nil {
+		return Amount{}, fmt.Errorf("no exchange rate from %s to %s", a.Currency, currency)
+	}
+	rate, err := e.opts.Rates.Rate(a.Currency, currency)
+	if err != nil {
+		return Amount{}, err
+	}
+	if rate == nil || rate.Sign() <= 0 {
+		return Amount{}, fmt.Errorf("wrong exchange rate from %s to %s", a.Currency, currency)
+	}
+	return Amount{Value: new(big.Rat).Mul(a.Value, rate), Currency: currency}, nil
+}
+
+// moneyBinary applies op to operands one of which at least is Money. The
+// right operand is converted to the currency of the left one when they
+// differ, which needs EvalOptions.Rates.
+func (e *evaluator) moneyBinary(op Token, l, r *Result) (*Result, error) {
+	x, lok := l.data.(Amount)
+	y, rok := r.data.(Amount)
+	switch {
+	case lok && rok:
+		y, err := e.convertMoney(y, x.Currency)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case OpAdd:
+			return moneyResult(new(big.Rat).Add(x.Value, y.Value), x.Currency), nil
+		case OpMinus:
+			return moneyResult(new(big.Rat).Sub(x.Value, y.Value), x.Currency), nil
+		case OpDivide:
+			if y.Value.Sign() == 0 {
+				return nil, errors.New("division by zero")
+			}
+			f, _ := new(big.Rat).Quo(x.Value, y.Value).Float32()
+			return &Result{kind: Float, data: f}, nil
+		case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte:
+			return compareResult(op, x.Value.Cmp(y.Value)), nil
+		}
+	case lok:
+		if f, ok := ratOf(r); ok {
+			switch op {
+			case OpMultiply:
+				return moneyResult(f.Mul(x.Value, f), x.Currency), nil
+			case OpDivide:
+				if f.Sign() == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return moneyResult(f.Quo(x.Value, f), x.Currency), nil
+			}
+		}
+	case rok:
+		if f, ok := ratOf(l); ok && op == OpMultiply {
+			return moneyResult(f.Mul(f, y.Value), y.Currency), nil
+		}
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+}
+
+func moneyResult(v *big.Rat, currency string) *Result {
+	return &Result{kind: Money, data: Amount{Value: v, Currency: currency}}
+}
+
+// ratOf returns the exact value of an Integer or the shortest decimal of a
+// Float.
+func ratOf(r *Result) (*big.Rat, bool) {
+	switch v := r.data.(type) {
+	case int:
+		return new(big.Rat).SetInt64(int64(v)), r.kind == Integer
+	case float32:
+		f, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(v), 'f', -1, 32))
+		return f, ok && r.kind == Float
+	}
+	return nil, false
+}
+
+// roundRat rounds v to digits decimal places. The modes are halfEven,
+// halfUp (half away from zero), halfDown (half toward zero), up (away
+// from zero), down (toward zero), ceiling and floor.
+func roundRat(v *big.Rat, digits int, mode string) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	num := new(big.Int).Mul(v.Num(), scale)
+	q, rem := new(big.Int).QuoRem(num, v.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// compare the dropped fraction with one half
+		half := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2)).Cmp(v.Denom())
+		away := false
+		switch mode {
+		case "halfEven":
+			away = half > 0 || half == 0 && q.Bit(0) == 1
+		case "halfUp":
+			away = half >= 0
+		case "halfDown":
+			away = half > 0
+		case "up":
+			away = true
+		case "ceiling":
+			away = v.Sign() > 0
+		case "floor":
+			away = v.Sign() < 0
+		}
+		if away {
+			q.Add(q, big.NewInt(int64(v.Sign())))
+		}
+	}
+	return new(big.Rat).SetFrac(q, scale)
+}
+
+var roundingModes = map[string]bool{
+	"halfEven": true, "halfUp": true, "halfDown": true,
+	"up": true, "down": true, "ceiling": true, "floor": true,
+}
+
+// ------------------------------------------------------------------
+
+// builtinMoney returns money(x, currency), as in money(12.50, "EUR").
+func builtinMoney(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("money", args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := stringArgs("money", args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return newMoney(args[0], strs[0])
+}
+
+// builtinRound rounds round(m, mode) to the minor units of its currency.
+// The mode defaults to halfEven, see roundRat.
+func builtinRound(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("round", args, 1, 2); err != nil {
+		return nil, err
+	}
+	a, ok := args[0].data.(Amount)
+	if !ok {
+		return nil, fmt.Errorf("round: wrong argument type[%v]", args[0].kind)
+	}
+	strs, err := stringArgs("round", args[1:])
+	if err != nil {
+		return nil, err
+	}
+	mode := "halfEven"
+	if len(strs) > 0 {
+		if mode = strs[0]; !roundingModes[mode] {
+			return nil, fmt.Errorf("round: unknown mode[%s]", mode)
+		}
+	}
+	digits, _ := currencyDigits(a.Currency)
+	return moneyResult(roundRat(a.Value, digits, mode), a.Currency), nil
+}
+
+func moneyMethod(name string, f func(a Amount) *Result) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		return f(args[0].data.(Amount)), nil
+	}
+}
@@ -1,75 +1,382 @@
 package gocalc
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// ParseOptions bounds the resources used to parse untrusted source text.
+// A zero limit means no limit.
+type ParseOptions struct {
+	// MaxSourceLen bounds the length of the source text in bytes.
+	MaxSourceLen int
+	// MaxDepth bounds the height of the AST: the nesting of parentheses,
+	// calls, indexes, selectors and unary and binary operators.
+	MaxDepth int
+	// MaxNodes bounds the number of nodes in the AST.
+	MaxNodes int
+	// MaxLiteralLen bounds the length of a literal in runes.
+	MaxLiteralLen int
+
+	// AllowAssign accepts the assignment statements =, += and -=, which
+	// write into the variables passed to the evaluation. Expressions are
+	// read-only by default, and assignments are syntax errors.
+	AllowAssign bool
+}
+
+// DefaultParseOptions are the options used by Parse. The depth limit keeps
+// deeply nested input from exhausting the stack.
+var DefaultParseOptions = ParseOptions{
+	MaxDepth: 1000,
+}
+
 type parser struct {
 	scanner *scanner
 	tok     Token
 	lit     string
+	pos     Position // position of tok
+	prevEnd Position // position right after the token before tok
+	err     error
+
+	opts  ParseOptions
+	depth int
+	nodes int
 }
 
-func ParserAST(expr string) Expr {
+// Parse parses the source text of an expression with DefaultParseOptions.
+// If the source contains errors, Parse returns the partial tree built so far
+// and the first error.
+func Parse(expr string) (Expr, error) {
+	return ParseWithOptions(expr, DefaultParseOptions)
+}
+
+// ParseWithOptions is like Parse but enforces the limits of opts.
+func ParseWithOptions(expr string, opts ParseOptions) (Expr, error) {
+	e, _, err := parse(expr, opts, false)
+	return e, err
+}
+
+// ParseWithComments is like ParseWithOptions but also returns the comments
+// of the source, as Comment tokens in source order. NewCommentMap attaches
+// them to the nodes of the tree.
+func ParseWithComments(expr string, opts ParseOptions) (Expr, []TokenInfo, error) {
+	return parse(expr, opts, true)
+}
+
+func parse(expr string, opts ParseOptions, comments bool) (Expr, []TokenInfo, error) {
+	if opts.MaxSourceLen > 0 && len(expr) > opts.MaxSourceLen {
+		return nil, nil, &Error{
+			Pos: Position{Offset: 0, Line: 1, Column: 1},
+			Err: fmt.Errorf("source length %d exceeds %d", len(expr), opts.MaxSourceLen),
+		}
+	}
+
 	p := &parser{
 		scanner: NewScanner(expr),
+		opts:    opts,
 	}
+	p.scanner.recordComments = comments
 	p.next()
-	e := p.ParseExpr()
+	e := p.parseProgram()
+	if p.tok != EOF {
+		p.errorf("unexpected token[%s]", p.tokString())
+	}
 
+	return e, p.scanner.comments, p.err
+}
+
+func ParserAST(expr string) Expr {
+	e, _ := Parse(expr)
 	return e
 }
 
 // ----------------------------------
 
+// parseProgram parses statements separated by semicolons. A single
+// expression statement is returned as it is, without a Program above it.
+func (p *parser) parseProgram() Expr {
+	var stmts []Expr
+	for {
+		stmts = append(stmts, p.parseStmt())
+		if p.tok != OpSemicolon {
+			break
+		}
+		p.next()
+		if p.tok == EOF {
+			break // a trailing semicolon
+		}
+	}
+
+	if len(stmts) == 1 {
+		if _, ok := stmts[0].(*LetExpr); !ok {
+			return stmts[0]
+		}
+	}
+	p.node()
+	return &Program{Stmts: stmts}
+}
+
+// parseStmt parses a let binding, an assignment or an expression.
+func (p *parser) parseStmt() Expr {
+	if p.tok != Let {
+		e := p.ParseExpr()
+		if isAssignOp(p.tok) {
+			return p.parseAssign(e)
+		}
+		return e
+	}
+
+	pos := p.pos
+	p.next()
+	name := IdentExpr{Name: p.lit, NamePos: p.pos}
+	if p.tok != Ident {
+		p.errorf("expected %s, found %s", Ident, p.tokString())
+	}
+	p.next()
+	p.expect(OpAssign)
+	value := p.ParseExpr()
+	p.node()
+	return &LetExpr{Name: name, Value: value, LetPos: pos}
+}
+
+func (p *parser) parseAssign(target Expr) Expr {
+	if !p.opts.AllowAssign {
+		p.errorf("assignment not allowed")
+		return target
+	}
+	if !isAssignable(target) {
+		p.errorf("cannot assign to %s", Format(target))
+		return target
+	}
+
+	op, pos := p.tok, p.pos
+	p.next()
+	value := p.ParseExpr()
+	p.node()
+	return &AssignExpr{Target: target, Op: op, Value: value, OpPos: pos}
+}
+
+// isAssignable reports whether e can be the target of an assignment.
+func isAssignable(e Expr) bool {
+	switch e.(type) {
+	case *IdentExpr, *AccessExpr, *IndexExpr:
+		return true
+	}
+	return false
+}
+
 func (p *parser) ParseExpr() Expr {
-	e := p.parseBinaryExpr(99)
+	e := p.parseLambdaOr(99)
 	return e
 }
 
+// argPrecedence stops the expressions of an argument list at the commas.
+var argPrecedence = OpPrecedence(OpSeparate)
+
+// parseLambdaOr parses a binary expression of the operators that bind
+// tighter than p0, or a lambda whose parameters are that expression.
+func (p *parser) parseLambdaOr(p0 Precedence) Expr {
+	e := p.parseBinaryExpr(p0)
+	if p.tok != OpArrow {
+		return e
+	}
+
+	lambda := &LambdaExpr{Arrow: p.pos}
+	if !lambdaParams(e, lambda) {
+		p.errorf("wrong lambda parameters[%s]", Format(e))
+		return e
+	}
+	p.next()
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+	lambda.Body = p.parseLambdaOr(p0)
+	p.node()
+	return lambda
+}
+
+// lambdaParams fills the parameters of l from x, y or (x, y), parsed as an
+// expression before the arrow was seen.
+func lambdaParams(e Expr, l *LambdaExpr) bool {
+	var collect func(e Expr) bool
+	collect = func(e Expr) bool {
+		switch ex := e.(type) {
+		case *IdentExpr:
+			for _, param := range l.Params {
+				if param.Name == ex.Name {
+					return false
+				}
+			}
+			l.Params = append(l.Params, *ex)
+			return true
+		case *BinaryExpr:
+			return ex.Op == OpSeparate && collect(ex.LE) && collect(ex.RE)
+		}
+		return false
+	}
+
+	switch ex := e.(type) {
+	case *IdentExpr:
+		return collect(ex)
+	case *ParenExpr:
+		l.Lparen = ex.Lparen
+		return collect(ex.E)
+	}
+	return false
+}
+
 func (p *parser) next() {
+	if p.err != nil {
+		return
+	}
+	p.prevEnd = p.scanner.pos()
 	p.tok, p.lit = p.scanner.scan()
+	p.pos = p.scanner.start
+	if p.tok == Illegal {
+		p.errorf("illegal token")
+	}
+}
+
+// errorf records the first error found while parsing. The parser then
+// sees EOF, so that it unwinds without reading further.
+func (p *parser) errorf(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = &Error{
+			Pos: p.pos,
+			End: p.scanner.pos(),
+			Err: fmt.Errorf("syntax error: "+format, args...),
+		}
+	}
+	p.tok, p.lit = EOF, ""
+}
+
+// node accounts for one more AST node.
+func (p *parser) node() {
+	p.nodes++
+	if p.opts.MaxNodes > 0 && p.nodes > p.opts.MaxNodes {
+		p.errorf("expression exceeds %d nodes", p.opts.MaxNodes)
+	}
+}
+
+// enter accounts for one more level of nesting; it reports false when the
+// depth limit is exceeded.
+func (p *parser) enter() bool {
+	p.depth++
+	if p.opts.MaxDepth > 0 && p.depth > p.opts.MaxDepth {
+		p.errorf("expression exceeds depth %d", p.opts.MaxDepth)
+		return false
+	}
+	return true
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+func (p *parser) expect(tok Token) Position {
+	pos := p.pos
+	if p.tok != tok {
+		p.errorf("expected %s, found %s", tok, p.tokString())
+	}
+	p.next()
+	return pos
+}
+
+func (p *parser) tokString() string {
+	if p.lit != "" {
+		return p.lit
+	}
+	return p.tok.String()
 }
 
 func (p *parser) parseLiteral() Expr {
 	var e Expr
 
+	if p.opts.MaxLiteralLen > 0 {
+		if n := utf8.RuneCountInString(p.lit); n > p.opts.MaxLiteralLen {
+			p.errorf("literal length %d exceeds %d", n, p.opts.MaxLiteralLen)
+		}
+	}
+
 	switch p.tok {
 	case Integer:
 		if data, err := strconv.Atoi(p.lit); err == nil {
 			e = &LiteralExpr{
-				Kind:    Integer,
-				Literal: p.lit,
-				Date:    data,
+				Kind:     Integer,
+				Literal:  p.lit,
+				Date:     data,
+				ValuePos: p.pos,
 			}
+		} else {
+			p.errorf("invalid integer[%s]", p.lit)
 		}
 		p.next()
 	case Float:
-		if data, err := strconv.ParseFloat(p.lit, 32); err == nil {
+		// checked as a float32, kept as a float64 for quantities
+		if _, err := strconv.ParseFloat(p.lit, 32); err == nil {
+			data, _ := strconv.ParseFloat(p.lit, 64)
 			e = &LiteralExpr{
-				Kind:    Float,
-				Literal: p.lit,
-				Date:    data,
+				Kind:     Float,
+				Literal:  p.lit,
+				Date:     data,
+				ValuePos: p.pos,
 			}
+		} else {
+			p.errorf("invalid float[%s]", p.lit)
+		}
+		p.next()
+	case Complex:
+		if v, err := strconv.ParseFloat(strings.TrimSuffix(p.lit, "i"), 64); err == nil {
+			e = &LiteralExpr{
+				Kind:     Complex,
+				Literal:  p.lit,
+				Date:     complex(0, v),
+				ValuePos: p.pos,
+			}
+		} else {
+			p.errorf("invalid complex[%s]", p.lit)
+		}
+		p.next()
+	case Duration:
+		if data, err := time.ParseDuration(p.lit); err == nil {
+			e = &LiteralExpr{
+				Kind:     Duration,
+				Literal:  p.lit,
+				Date:     data,
+				ValuePos: p.pos,
+			}
+		} else {
+			p.errorf("invalid duration[%s]", p.lit)
 		}
 		p.next()
 	case Char:
-		data, _, _, err := strconv.UnquoteChar(p.lit, byte('"'))
-		if err == nil {
+		data, _, tail, err := strconv.UnquoteChar(p.lit[1:len(p.lit)-1], '\'')
+		if err == nil && tail == "" {
 			e = &LiteralExpr{
-				Kind:    Integer, // rune = int
-				Literal: p.lit,
-				Date:    int(data),
+				Kind:     Char,
+				Literal:  p.lit,
+				Date:     data,
+				ValuePos: p.pos,
 			}
+		} else {
+			p.errorf("invalid char[%s]", p.lit)
 		}
 		p.next()
 	case String:
-		if data, err := strconv.Unquote(p.lit); err == nil {
+		// escapes such as \xff must not leave the string invalid UTF-8
+		if data, err := strconv.Unquote(p.lit); err == nil && utf8.ValidString(data) {
 			e = &LiteralExpr{
-				Kind:    String,
-				Literal: p.lit,
-				Date:    data,
+				Kind:     String,
+				Literal:  p.lit,
+				Date:     data,
+				ValuePos: p.pos,
 			}
+		} else {
+			p.errorf("invalid string[%s]", p.lit)
 		}
 		p.next()
 	case Bool:
@@ -78,82 +385,221 @@ func (p *parser) parseLiteral() Expr {
 			data = true
 		}
 		e = &LiteralExpr{
-			Kind:    Bool,
-			Literal: p.lit,
-			Date:    data,
+			Kind:     Bool,
+			Literal:  p.lit,
+			Date:     data,
+			ValuePos: p.pos,
 		}
 		p.next()
+	default:
+		p.errorf("unexpected token[%s]", p.tokString())
+	}
+	if e != nil {
+		p.node()
 	}
 	return e
 }
 
+// parseUnit parses the unit of measure that follows the number x, such as
+// kg or m/s^2. The operators of a unit are written without spaces around
+// them: 5 m / t divides 5 m by t. The space before the unit is required,
+// as 5m is the duration of five minutes.
+func (p *parser) parseUnit(x Expr) Expr {
+	u := &UnitExpr{X: x, UnitPos: p.pos}
+	var b strings.Builder
+	for p.err == nil {
+		if p.tok != Ident {
+			p.errorf("expected unit, found %s", p.tokString())
+			break
+		}
+		b.WriteString(p.lit)
+		p.next()
+		if p.tok == OpBitwiseXor && p.adjacent() {
+			b.WriteString("^")
+			p.next()
+			if p.tok == OpMinus && p.adjacent() {
+				b.WriteString("-")
+				p.next()
+			}
+			if p.tok != Integer || !p.adjacent() {
+				p.errorf("expected unit exponent, found %s", p.tokString())
+				break
+			}
+			b.WriteString(p.lit)
+			p.next()
+		}
+		if (p.tok != OpMultiply && p.tok != OpDivide) || !p.adjacent() {
+			break
+		}
+		b.WriteString(p.tok.String())
+		p.next()
+		if !p.adjacent() {
+			p.errorf("expected unit, found %s", p.tokString())
+		}
+	}
+	u.Unit = b.String()
+	if _, err := parseUnit(u.Unit); err != nil && p.err == nil {
+		p.errorf("%v", err)
+	}
+	p.node()
+	return u
+}
+
+// adjacent reports whether no space separates tok from the token before it.
+func (p *parser) adjacent() bool {
+	return p.pos.Offset == p.prevEnd.Offset
+}
+
 func (p *parser) parseOperand() Expr {
 	var e Expr
 	switch p.tok {
 	case Ident:
 		e = &IdentExpr{
-			Name: p.lit,
+			Name:    p.lit,
+			NamePos: p.pos,
 		}
+		p.node()
 		p.next()
 	case OpLParen:
+		lparen := p.pos
 		p.next()
-		e = p.ParseExpr()
-		p.next()
-		e = &ParenExpr{E: e}
+		x := p.ParseExpr()
+		rparen := p.expect(OpRParen)
+		e = &ParenExpr{E: x, Lparen: lparen, Rparen: rparen}
+		p.node()
 	default:
 		e = p.parseLiteral()
+		if lit, ok := e.(*LiteralExpr); ok && (lit.Kind == Integer || lit.Kind == Float) && p.tok == Ident {
+			e = p.parseUnit(e)
+		}
 	}
 
-	switch p.tok {
-	case OpLBracket:
-		p.next()
-		index := p.ParseExpr()
-		p.next()
-		e = &IndexExpr{
-			E:     e,
-			Index: index,
+	// a.b[c].d(e): the tree is one level deeper with every selector
+	levels := 0
+	defer func() { p.depth -= levels }()
+	for {
+		switch p.tok {
+		case OpLParen, OpLBracket, OpAccess:
+			levels++
+			if !p.enter() {
+				return e
+			}
 		}
-	case OpAccess:
-		p.next()
 		switch p.tok {
-		case Ident:
-			e = &AccessExpr{
-				E: e,
-				Access: IdentExpr{
-					Name: p.lit,
-				},
+		case OpLParen:
+			call := &CallExpr{Fun: e, Lparen: p.pos}
+			p.next()
+			for p.tok != OpRParen && p.tok != EOF {
+				call.Args = append(call.Args, p.parseLambdaOr(argPrecedence))
+				if p.tok != OpSeparate {
+					break
+				}
+				p.next()
+			}
+			call.Rparen = p.expect(OpRParen)
+			e = call
+			p.node()
+		case OpLBracket:
+			lbrack := p.pos
+			p.next()
+			var index Expr
+			if p.tok != OpColon {
+				index = p.ParseExpr()
 			}
+			if p.tok == OpColon {
+				// s[lo:hi], s[:hi], s[lo:]
+				p.next()
+				var hi Expr
+				if p.tok != OpRBracket {
+					hi = p.ParseExpr()
+				}
+				rbrack := p.expect(OpRBracket)
+				e = &SliceExpr{
+					E:      e,
+					Lo:     index,
+					Hi:     hi,
+					Lbrack: lbrack,
+					Rbrack: rbrack,
+				}
+			} else {
+				rbrack := p.expect(OpRBracket)
+				e = &IndexExpr{
+					E:      e,
+					Index:  index,
+					Lbrack: lbrack,
+					Rbrack: rbrack,
+				}
+			}
+			p.node()
+		case OpAccess:
+			p.next()
+			switch p.tok {
+			case Ident:
+				e = &AccessExpr{
+					E: e,
+					Access: IdentExpr{
+						Name:    p.lit,
+						NamePos: p.pos,
+					},
+				}
+				p.node()
+			default:
+				p.errorf("expected %s, found %s", Ident, p.tokString())
+			}
+			p.next()
+		default:
+			return e
 		}
-		p.next()
 	}
-
-	return e
 }
 
 func (p *parser) parseUnaryExpr() Expr {
-	switch p.tok {
-	case OpAdd, OpMinus, OpNot, OpBitwiseXor, OpBitwiseNot:
-		op := p.tok
+	if !p.enter() {
+		return nil
+	}
+	defer p.leave()
+
+	if isUnaryOp(p.tok) {
+		op, pos := p.tok, p.pos
 		p.next()
 		e := p.parseUnaryExpr()
-		return &UnaryExpr{Op: op, E: e}
+		p.node()
+		return &UnaryExpr{Op: op, E: e, OpPos: pos}
 	}
 
-	return p.parseOperand()
+	// ** binds tighter than a unary operator on its left, and takes one on
+	// its right: -2 ** 2 is -(2 ** 2), 2 ** -1 is 2 ** (-1), and
+	// 2 ** 3 ** 2 is 2 ** (3 ** 2)
+	x := p.parseOperand()
+	if p.tok == OpPower {
+		pos := p.pos
+		p.next()
+		y := p.parseUnaryExpr()
+		p.node()
+		return &BinaryExpr{LE: x, Op: OpPower, RE: y, OpPos: pos}
+	}
+	return x
 }
 
 func (p *parser) parseBinaryExpr(p0 Precedence) Expr {
 	le := p.parseUnaryExpr()
-	// 1 + 2 + 3
+	// 1 + 2 + 3: the tree is one level deeper with every operator
+	levels := 0
+	defer func() { p.depth -= levels }()
 	for {
-		op := p.tok
+		op, pos := p.tok, p.pos
 		p1 := op.Precedence()
 		if p1 == 0 || !p1.PrecedenceWith(p0) {
 			break
 		}
+		levels++
+		if !p.enter() {
+			break
+		}
 		p.next()
 		re := p.parseBinaryExpr(p1)
-		le = &BinaryExpr{LE: le, Op: op, RE: re}
+		le = &BinaryExpr{LE: le, Op: op, RE: re, OpPos: pos}
+		p.node()
 	}
 
 	return le
@@ -0,0 +1,61 @@
+package gocalc
+
+import (
+	"fmt"
+)
+
+// Position describes a location in the source text of an expression.
+// A Position is valid if the line number is > 0.
+type Position struct {
+	Offset int // rune offset, starting at 0
+	Line   int // line number, starting at 1
+	Column int // column number, starting at 1 (rune count)
+}
+
+func (pos Position) IsValid() bool {
+	return pos.Line > 0
+}
+
+// String returns a string in the form line:column, or - if pos is invalid.
+func (pos Position) String() string {
+	if !pos.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", pos.Line, pos.Column)
+}
+
+// advance returns the position n runes after pos on the same line.
+func (pos Position) advance(n int) Position {
+	if !pos.IsValid() {
+		return pos
+	}
+	pos.Offset += n
+	pos.Column += n
+	return pos
+}
+
+// ------------------------------------------------------------------
+
+// Error is an error located at a span of the source text, reported by the
+// parser or by the evaluator for the sub-expression that failed.
+type Error struct {
+	Pos Position
+	End Position
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorAt locates err at the span of expr, unless it is already located.
+func errorAt(expr Expr, err error) error {
+	if _, ok := err.(*Error); ok || expr == nil || !expr.Pos().IsValid() {
+		return err
+	}
+	return &Error{Pos: expr.Pos(), End: expr.End(), Err: err}
+}
@@ -0,0 +1,57 @@
+package gocalc
+
+import (
+	"errors"
+)
+
+// Resolver supplies the values of the variables referenced by an expression.
+// Resolve is called only when the evaluator needs the named value, so values
+// can be fetched lazily from a database row, a protobuf, request headers or
+// any other source. It reports whether the name is defined; a non-nil error
+// aborts the evaluation.
+type Resolver interface {
+	Resolve(name string) (interface{}, bool, error)
+}
+
+// Assigner is implemented by Resolvers whose variables can be assigned by
+// expressions parsed with ParseOptions.AllowAssign. Resolvers that do not
+// implement it are read-only.
+type Assigner interface {
+	Assign(name string, value interface{}) error
+}
+
+// ResolverFunc adapts an ordinary function to a Resolver.
+type ResolverFunc func(name string) (interface{}, bool, error)
+
+func (f ResolverFunc) Resolve(name string) (interface{}, bool, error) {
+	return f(name)
+}
+
+// MapResolver resolves variables from a params map.
+type MapResolver map[string]interface{}
+
+func (m MapResolver) Resolve(name string) (interface{}, bool, error) {
+	val, find := m[name]
+	return val, find, nil
+}
+
+func (m MapResolver) Assign(name string, value interface{}) error {
+	if m == nil {
+		return errors.New("assignment to nil map")
+	}
+	m[name] = storeValue(m[name], value)
+	return nil
+}
+
+// newResolver returns the Resolver for a root scope passed to CalcWith.
+func newResolver(v interface{}) (Resolver, error) {
+	switch r := v.(type) {
+	case Resolver:
+		return r, nil
+	case map[string]interface{}:
+		return MapResolver(r), nil
+	case nil:
+		return MapResolver(nil), nil
+	}
+	return newStructResolver(v)
+}
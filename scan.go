@@ -4,25 +4,39 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 type scanner struct {
 	source []rune
 	index  int
-	char   rune // next one
+	char   rune     // next one
+	line   int      // line of char
+	column int      // column of char
+	start  Position // start of the last scanned token
+
+	recordComments bool        // collect the comments skipped
+	comments       []TokenInfo // comments skipped so far
 }
 
 func NewScanner(e string) *scanner {
-	if len(e) == 0 {
-		return nil
-	}
+	return newScannerAt([]rune(e), Position{Offset: 0, Line: 1, Column: 1})
+}
 
+// newScannerAt returns a scanner of source that starts at pos.
+func newScannerAt(source []rune, pos Position) *scanner {
 	l := &scanner{
-		source: []rune(e),
-		index:  0,
+		source: source,
+		index:  pos.Offset,
+		char:   -1,
+		line:   pos.Line,
+		column: pos.Column,
 	}
 
-	l.char = l.source[0]
+	if l.index < len(l.source) {
+		l.char = l.source[l.index]
+	}
 
 	return l
 }
@@ -39,6 +53,14 @@ func (s *scanner) String() string {
 
 // read next one
 func (s *scanner) next() {
+	if s.index < len(s.source) {
+		if s.char == '\n' {
+			s.line++
+			s.column = 1
+		} else {
+			s.column++
+		}
+	}
 	s.index++
 	if s.index < len(s.source) {
 		s.char = s.source[s.index]
@@ -47,6 +69,11 @@ func (s *scanner) next() {
 	s.char = -1
 }
 
+// pos returns the position of the current char.
+func (s *scanner) pos() Position {
+	return Position{Offset: s.index, Line: s.line, Column: s.column}
+}
+
 func (s *scanner) nextChar() rune {
 	idx := s.index + 1
 	if idx < len(s.source) {
@@ -55,16 +82,84 @@ func (s *scanner) nextChar() rune {
 	return -1
 }
 
+// skip skips whitespace and comments.
 func (s *scanner) skip() {
+	for {
+		if IsSpace(s.char) {
+			s.skipSpace()
+		} else if !s.skipComment() {
+			return
+		}
+	}
+}
+
+func (s *scanner) skipSpace() {
 	for IsSpace(s.char) {
 		s.next()
 	}
 }
 
+// isComment reports whether a comment starts at the current char.
+func (s *scanner) isComment() bool {
+	return s.char == '/' && (s.nextChar() == '/' || s.nextChar() == '*')
+}
+
+// skipComment skips the comment at the current char, if any. A block
+// comment that is not terminated is left to scan, which reports it.
+func (s *scanner) skipComment() bool {
+	if !s.isComment() {
+		return false
+	}
+	saved := *s
+	if !s.scanComment() {
+		*s = saved
+		return false
+	}
+	if s.recordComments {
+		s.comments = append(s.comments, TokenInfo{
+			Kind:    Comment,
+			Literal: string(s.source[saved.index:s.index]),
+			Pos:     saved.pos(),
+			End:     s.pos(),
+		})
+	}
+	return true
+}
+
+// scanComment reads a // or /* */ comment, and reports whether it is
+// terminated. A line comment ends before the newline.
+func (s *scanner) scanComment() bool {
+	s.next()
+	if s.char == '/' {
+		for s.char != '\n' && s.char >= 0 {
+			s.next()
+		}
+		return true
+	}
+
+	s.next()
+	for s.char >= 0 {
+		if s.char == '*' && s.nextChar() == '/' {
+			s.next()
+			s.next()
+			return true
+		}
+		s.next()
+	}
+	return false
+}
+
 // -------------------------------------------------------------------------------------
 
+// Scan returns the next token and its literal text, or EOF at the end of
+// the source.
+func (s *scanner) Scan() (Token, string) {
+	return s.scan()
+}
+
 func (s *scanner) scan() (Token, string) {
 	s.skip()
+	s.start = s.pos()
 	if s.index >= len(s.source) {
 		return EOF, ""
 	}
@@ -83,12 +178,35 @@ func (s *scanner) scan() (Token, string) {
 	default:
 		switch s.char {
 		case '+':
-			tok, lit = OpAdd, "+"
+			if '=' == s.nextChar() {
+				s.next()
+				tok, lit = OpAddAssign, "+="
+			} else {
+				tok, lit = OpAdd, "+"
+			}
 		case '-':
-			tok, lit = OpMinus, "-"
+			if '=' == s.nextChar() {
+				s.next()
+				tok, lit = OpMinusAssign, "-="
+			} else if '>' == s.nextChar() {
+				s.next()
+				tok, lit = OpArrow, "->"
+			} else {
+				tok, lit = OpMinus, "-"
+			}
 		case '*':
-			tok, lit = OpMultiply, "*"
+			if '*' == s.nextChar() {
+				s.next()
+				tok, lit = OpPower, "**"
+			} else {
+				tok, lit = OpMultiply, "*"
+			}
 		case '/':
+			if '*' == s.nextChar() {
+				// a block comment that skip left, as it is not terminated
+				s.scanComment()
+				return Illegal, ""
+			}
 			tok, lit = OpDivide, "/"
 		case '%':
 			tok, lit = OpModulus, "%"
@@ -102,6 +220,12 @@ func (s *scanner) scan() (Token, string) {
 			tok, lit = OpRBracket, "]"
 		case '.':
 			tok, lit = OpAccess, "."
+		case ';':
+			tok, lit = OpSemicolon, ";"
+		case ':':
+			tok, lit = OpColon, ":"
+		case ',':
+			tok, lit = OpSeparate, ","
 		case '!':
 			if '=' == s.nextChar() {
 				s.next()
@@ -113,8 +237,11 @@ func (s *scanner) scan() (Token, string) {
 			if '=' == s.nextChar() {
 				s.next()
 				tok, lit = OpEq, "=="
+			} else if '>' == s.nextChar() {
+				s.next()
+				tok, lit = OpArrow, "=>"
 			} else {
-				tok, lit = Illegal, "" // Illegal
+				tok, lit = OpAssign, "="
 			}
 		case '&':
 			if '&' == s.nextChar() {
@@ -162,7 +289,7 @@ func (s *scanner) scan() (Token, string) {
 	return tok, lit
 }
 
-// scanNumber fun look for Integer and Float
+// scanNumber fun look for Integer, Float, Complex and Duration
 func (s *scanner) scanNumber() (Token, string) {
 	start := s.index
 	tok := Integer
@@ -180,15 +307,46 @@ func (s *scanner) scanNumber() (Token, string) {
 			s.next()
 		}
 	}
+
+	// 1h30m, 1.5s: a unit glued to the number makes it a duration, while
+	// 5 m with a space is a quantity of metres, see parser.parseUnit
+	if IsLetter(s.char) {
+		end := s.index
+		for IsLetter(s.char) || IsDecimal(s.char) ||
+			s.char == '.' && IsDecimal(s.source[s.index-1]) {
+			s.next()
+		}
+		lit := string(s.source[start:s.index])
+		if s.index == end+1 && s.source[end] == 'i' {
+			// 3i, 2.5i: an imaginary number
+			return Complex, lit
+		}
+		if _, err := time.ParseDuration(lit); err != nil {
+			return Illegal, ""
+		}
+		return Duration, lit
+	}
 	return tok, string(s.source[start:s.index])
 }
 
 // scanEscape parses an escape-sequence where rune is the accepted escaped quote
-func (s *scanner) scanEscape() bool {
+func (s *scanner) scanEscape(quote rune) bool {
 	s.next()
+	n, base, max := 0, uint32(0), uint32(0)
 	switch s.char {
-	case 'a', 'b', 'f', 'n', 'r', 't', 'v', '\\', '"', '0':
+	case 'a', 'b', 'f', 'n', 'r', 't', 'v', '\\', quote:
 		return true
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		n, base, max = 3, 8, 255
+	case 'x':
+		s.next()
+		n, base, max = 2, 16, 255
+	case 'u':
+		s.next()
+		n, base, max = 4, 16, unicode.MaxRune
+	case 'U':
+		s.next()
+		n, base, max = 8, 16, unicode.MaxRune
 	default:
 		//msg := "unknown escape sequence"
 		//if l.char < 0 {
@@ -197,6 +355,34 @@ func (s *scanner) scanEscape() bool {
 		// s.error(offs, msg)
 		return false
 	}
+
+	var x uint32
+	for {
+		d := uint32(digitVal(s.char))
+		if d >= base {
+			return false
+		}
+		x = x*base + d
+		n--
+		if n == 0 {
+			break
+		}
+		s.next()
+	}
+
+	return x <= max && (x < 0xD800 || x >= 0xE000)
+}
+
+func digitVal(c rune) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c && c <= 'f':
+		return int(c - 'a' + 10)
+	case 'A' <= c && c <= 'F':
+		return int(c - 'A' + 10)
+	}
+	return 16 // larger than any legal digit val
 }
 
 // scanString fun look for string
@@ -206,10 +392,10 @@ func (s *scanner) scanString() (Token, string) {
 
 	for {
 		s.next()
-		if s.char == '"' {
+		if s.char == '"' || s.char < 0 {
 			break
 		} else if s.char == '\\' {
-			if !s.scanEscape() {
+			if !s.scanEscape('"') {
 				return Illegal, ""
 			}
 		}
@@ -229,7 +415,7 @@ func (s *scanner) scanChar() (Token, string) {
 
 	s.next()
 	if s.char == '\\' {
-		if !s.scanEscape() {
+		if !s.scanEscape('\'') {
 			return Illegal, ""
 		}
 	} else if s.char < 0 {
@@ -256,6 +442,8 @@ func (s *scanner) scanIdentifier() (Token, string) {
 		tok = Bool
 	} else if ident == FALSE {
 		tok = Bool
+	} else if ident == LET {
+		tok = Let
 	}
 
 	return tok, ident
@@ -0,0 +1,143 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// IndexError is returned when an index is out of the range of a string,
+// slice or array. Index is the index as written, negative ones included.
+type IndexError struct {
+	Index int
+	Len   int
+}
+
+func (e *IndexError) Error() string {
+	return fmt.Sprintf("index out of range[%d] with length %d", e.Index, e.Len)
+}
+
+// SliceError is returned when the bounds of a slice expression are out of
+// the range of the value or inverted.
+type SliceError struct {
+	Lo  int
+	Hi  int
+	Len int
+}
+
+func (e *SliceError) Error() string {
+	return fmt.Sprintf("slice bounds out of range[%d:%d] with length %d", e.Lo, e.Hi, e.Len)
+}
+
+// elemIndex returns the position in a sequence of length n of an Integer
+// index, which counts from the end when negative: -1 is the last element.
+func elemIndex(index *Result, n int) (int, error) {
+	i, ok := index.data.(int)
+	if index.kind != Integer || !ok {
+		return 0, fmt.Errorf("wrong index type[%v]", index.kind)
+	}
+	pos := i
+	if pos < 0 {
+		pos += n
+	}
+	if pos < 0 || pos >= n {
+		return 0, &IndexError{Index: i, Len: n}
+	}
+	return pos, nil
+}
+
+// ------------------------------------------------------------------
+
+// calcSliceExpr takes the runes of a string, or the elements of a slice or
+// an array, from Lo up to Hi. Negative bounds count from the end.
+func (e *evaluator) calcSliceExpr(expr *SliceExpr) (*Result, error) {
+	obj, err := e.calcExpr(expr.E)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := obj.data.(string); ok && obj.kind == String {
+		runes := []rune(s)
+		lo, hi, err := e.bounds(expr, len(runes))
+		if err != nil {
+			return nil, err
+		}
+		return &Result{kind: String, data: string(runes[lo:hi])}, nil
+	}
+
+	v, err := sequence(obj)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi, err := e.bounds(expr, v.Len())
+	if err != nil {
+		return nil, err
+	}
+	if v.Kind() == reflect.Array && !v.CanAddr() {
+		// only addressable arrays can be sliced
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		v = c
+	}
+	return e.value(v.Slice(lo, hi).Interface())
+}
+
+// sequence returns the slice or array value of obj.
+func sequence(obj *Result) (reflect.Value, error) {
+	if obj.kind != Object {
+		return reflect.Value{}, fmt.Errorf("cannot slice %v", obj.kind)
+	}
+	v := reflect.ValueOf(obj.data)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}, errors.New("slice of nil value")
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return reflect.Value{}, fmt.Errorf("cannot slice %v", v.Kind())
+	}
+	return v, nil
+}
+
+// bounds evaluates the bounds of expr for a sequence of length n. The
+// missing ones are the start and the end of the sequence.
+func (e *evaluator) bounds(expr *SliceExpr, n int) (int, int, error) {
+	lo, hi := 0, n
+	var err error
+	if expr.Lo != nil {
+		if lo, err = e.bound(expr.Lo); err != nil {
+			return 0, 0, err
+		}
+	}
+	if expr.Hi != nil {
+		if hi, err = e.bound(expr.Hi); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	i, j := lo, hi
+	if i < 0 {
+		i += n
+	}
+	if j < 0 {
+		j += n
+	}
+	if i < 0 || j < i || j > n {
+		return 0, 0, &SliceError{Lo: lo, Hi: hi, Len: n}
+	}
+	return i, j, nil
+}
+
+// bound evaluates a slice bound, which must be an Integer.
+func (e *evaluator) bound(expr Expr) (int, error) {
+	r, err := e.calcExpr(expr)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := r.data.(int)
+	if r.kind != Integer || !ok {
+		return 0, fmt.Errorf("wrong slice bound type[%v]", r.kind)
+	}
+	return i, nil
+}
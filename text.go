@@ -0,0 +1,159 @@
+package gocalc
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization is the Unicode normalization form strings are brought to
+// before they are compared, see EvalOptions.Normalization.
+type Normalization int
+
+const (
+	// NoNormalization compares strings code point by code point.
+	NoNormalization Normalization = iota
+	// NFC compares strings in canonical composition, so that "\u00e9"
+	// equals "e\u0301".
+	NFC
+	// NFKC compares strings in compatibility composition, so that
+	// "\ufb01" equals "fi" as well.
+	NFKC
+)
+
+func (n Normalization) String() string {
+	switch n {
+	case NoNormalization:
+		return "none"
+	case NFC:
+		return "NFC"
+	case NFKC:
+		return "NFKC"
+	}
+	return fmt.Sprintf("Normalization(%d)", int(n))
+}
+
+// Rune is the Go value of a Char stored into a collection or a variable,
+// such as the elements of map(items, x => 'a'). A rune is an int32 to Go
+// and would read back as an Integer; a Rune passed in reads as a Char.
+type Rune rune
+
+func (r Rune) String() string { return string(r) }
+
+// goValue returns the Go value r is stored as, which keeps a Char a Char
+// when it is read back.
+func goValue(r *Result) interface{} {
+	if v, ok := r.data.(rune); ok && r.kind == Char {
+		return Rune(v)
+	}
+	return r.data
+}
+
+// collate returns s as it is compared: normalized and, with
+// EvalOptions.FoldCase, case folded.
+func (e *evaluator) collate(s string) string {
+	return collate(s, e.opts.Normalization, e.opts.FoldCase)
+}
+
+func collate(s string, n Normalization, foldCase bool) string {
+	var form norm.Form
+	switch n {
+	case NFC:
+		form = norm.NFC
+	case NFKC:
+		form = norm.NFKC
+	default:
+		if foldCase {
+			return fold(s)
+		}
+		return s
+	}
+	s = form.String(s)
+	if foldCase {
+		// folding may undo the normalization, which is applied again
+		s = form.String(fold(s))
+	}
+	return s
+}
+
+func (e *evaluator) compareText(x, y string) int {
+	return strings.Compare(e.collate(x), e.collate(y))
+}
+
+// textOf returns the text of a String or a Char.
+func textOf(r *Result) (string, bool) {
+	switch v := r.data.(type) {
+	case string:
+		return v, r.kind == String
+	case rune:
+		return string(v), r.kind == Char
+	}
+	return "", false
+}
+
+// textBinary applies op to operands one of which at least is a String or a
+// Char. A Char is added to a String as a one-character string, but it is
+// not a number: 'a' + 1 is an error.
+func (e *evaluator) textBinary(op Token, l, r *Result) (*Result, error) {
+	x, lok := textOf(l)
+	y, rok := textOf(r)
+	if lok && rok {
+		switch op {
+		case OpAdd:
+			if l.kind == Char && r.kind == Char {
+				break
+			}
+			if err := e.checkString(len(x) + len(y)); err != nil {
+				return nil, err
+			}
+			return &Result{kind: String, data: x + y}, nil
+		case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte:
+			if l.kind == r.kind {
+				return compareResult(op, e.compareText(x, y)), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+}
+
+// ------------------------------------------------------------------
+
+// charAt returns the character of s at the rune index, counted from the
+// end when negative.
+func charAt(s string, index *Result) (*Result, error) {
+	runes := []rune(s)
+	i, err := elemIndex(index, len(runes))
+	if err != nil {
+		return nil, err
+	}
+	return &Result{kind: Char, data: runes[i]}, nil
+}
+
+// ------------------------------------------------------------------
+
+// upper and lower map the whole string, so that "ß" is upper cased to
+// "SS", as strings.ToUpper does not.
+func upper(s string) string { return cases.Upper(language.Und).String(s) }
+func lower(s string) string { return cases.Lower(language.Und).String(s) }
+
+// fold returns the case folding of s, the form in which strings that
+// differ only in case are equal: "Straße" and "STRASSE" both fold to
+// "strasse".
+func fold(s string) string { return cases.Fold().String(s) }
+
+// builtinEqualFold reports whether equalFold(s, t) are equal under full
+// Unicode case folding and the normalization of the evaluation.
+func builtinEqualFold(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("equalFold", args, 2, 2); err != nil {
+		return nil, err
+	}
+	strs, err := stringArgs("equalFold", args)
+	if err != nil {
+		return nil, err
+	}
+	n := e.opts.Normalization
+	return &Result{kind: Bool, data: collate(strs[0], n, true) == collate(strs[1], n, true)}, nil
+}
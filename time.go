@@ -0,0 +1,269 @@
+package gocalc
+
+import (
+	"fmt"
+	"time"
+)
+
+// layouts are the names accepted for the layout argument of parseTime and
+// formatTime. Any other layout is used as given, in the reference time
+// notation of the time package.
+var layouts = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC822":      time.RFC822,
+	"Kitchen":     time.Kitchen,
+	"DateTime":    "2006-01-02 15:04:05",
+	"DateOnly":    "2006-01-02",
+	"TimeOnly":    "15:04:05",
+}
+
+// now returns the current time of the evaluation, as read from
+// EvalOptions.Now.
+func (e *evaluator) now() time.Time {
+	if e.opts.Now != nil {
+		return e.opts.Now()
+	}
+	return time.Now()
+}
+
+// timeBinary applies op to operands one of which at least is a Time or a
+// Duration.
+func timeBinary(op Token, l, r *Result) (*Result, error) {
+	switch x := l.data.(type) {
+	case time.Time:
+		switch y := r.data.(type) {
+		case time.Time:
+			switch op {
+			case OpMinus:
+				return &Result{kind: Duration, data: x.Sub(y)}, nil
+			case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte:
+				return compareResult(op, compareTime(x, y)), nil
+			}
+		case time.Duration:
+			switch op {
+			case OpAdd:
+				return &Result{kind: Time, data: x.Add(y)}, nil
+			case OpMinus:
+				return &Result{kind: Time, data: x.Add(-y)}, nil
+			}
+		}
+	case time.Duration:
+		switch y := r.data.(type) {
+		case time.Time:
+			if op == OpAdd {
+				return &Result{kind: Time, data: y.Add(x)}, nil
+			}
+		case time.Duration:
+			switch op {
+			case OpAdd:
+				return &Result{kind: Duration, data: x + y}, nil
+			case OpMinus:
+				return &Result{kind: Duration, data: x - y}, nil
+			case OpDivide:
+				if y == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				return &Result{kind: Float, data: float32(float64(x) / float64(y))}, nil
+			case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte:
+				return compareResult(op, compareInt(int(x), int(y))), nil
+			}
+		case int:
+			switch op {
+			case OpMultiply:
+				return &Result{kind: Duration, data: x * time.Duration(y)}, nil
+			case OpDivide:
+				if y == 0 {
+					return nil, fmt.Errorf("division by zero")
+				}
+				return &Result{kind: Duration, data: x / time.Duration(y)}, nil
+			}
+		}
+	case int:
+		if y, ok := r.data.(time.Duration); ok && op == OpMultiply {
+			return &Result{kind: Duration, data: time.Duration(x) * y}, nil
+		}
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+}
+
+func compareTime(x, y time.Time) int {
+	switch {
+	case x.Before(y):
+		return -1
+	case x.After(y):
+		return 1
+	}
+	return 0
+}
+
+// compareResult turns the order c of two operands into the result of the
+// comparison operator op.
+func compareResult(op Token, c int) *Result {
+	var data bool
+	switch op {
+	case OpEq:
+		data = c == 0
+	case OpNeq:
+		data = c != 0
+	case OpGt:
+		data = c > 0
+	case OpLt:
+		data = c < 0
+	case OpGte:
+		data = c >= 0
+	case OpLte:
+		data = c <= 0
+	}
+	return &Result{kind: Bool, data: data}
+}
+
+// ------------------------------------------------------------------
+
+func builtinNow(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("now", args, 0, 0); err != nil {
+		return nil, err
+	}
+	return &Result{kind: Time, data: e.now()}, nil
+}
+
+// builtinParseTime parses parseTime(s, layout, zone). The layout defaults
+// to RFC3339; the zone, which defaults to UTC, applies to layouts that do
+// not carry an offset.
+func builtinParseTime(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("parseTime", args, 1, 3); err != nil {
+		return nil, err
+	}
+	strs, err := stringArgs("parseTime", args)
+	if err != nil {
+		return nil, err
+	}
+	layout, loc, err := layoutArgs(strs[1:])
+	if err != nil {
+		return nil, err
+	}
+	t, err := time.ParseInLocation(layout, strs[0], loc)
+	if err != nil {
+		return nil, fmt.Errorf("parseTime: %v", err)
+	}
+	return &Result{kind: Time, data: t}, nil
+}
+
+// builtinFormatTime formats formatTime(t, layout, zone). The layout
+// defaults to RFC3339, and the time is shown in zone if one is given.
+func builtinFormatTime(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("formatTime", args, 1, 3); err != nil {
+		return nil, err
+	}
+	t, ok := args[0].data.(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("formatTime: wrong argument type[%v]", args[0].kind)
+	}
+	strs, err := stringArgs("formatTime", args[1:])
+	if err != nil {
+		return nil, err
+	}
+	layout, loc, err := layoutArgs(strs)
+	if err != nil {
+		return nil, err
+	}
+	if len(strs) == 2 {
+		t = t.In(loc)
+	}
+	return &Result{kind: String, data: t.Format(layout)}, nil
+}
+
+func builtinParseDuration(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("parseDuration", args, 1, 1); err != nil {
+		return nil, err
+	}
+	strs, err := stringArgs("parseDuration", args)
+	if err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(strs[0])
+	if err != nil {
+		return nil, fmt.Errorf("parseDuration: %v", err)
+	}
+	return &Result{kind: Duration, data: d}, nil
+}
+
+// builtinInZone returns the same instant as shown in another time zone.
+func builtinInZone(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("inZone", args, 2, 2); err != nil {
+		return nil, err
+	}
+	t, ok := args[0].data.(time.Time)
+	if !ok {
+		return nil, fmt.Errorf("inZone: wrong argument type[%v]", args[0].kind)
+	}
+	strs, err := stringArgs("inZone", args[1:])
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(strs[0])
+	if err != nil {
+		return nil, err
+	}
+	return &Result{kind: Time, data: t.In(loc)}, nil
+}
+
+func stringArgs(name string, args []*Result) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.data.(string)
+		if arg.kind != String || !ok {
+			return nil, fmt.Errorf("%s: wrong argument type[%v]", name, arg.kind)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+// layoutArgs reads the optional layout and zone arguments.
+func layoutArgs(args []string) (string, *time.Location, error) {
+	layout, loc := time.RFC3339, time.UTC
+	if len(args) > 0 {
+		layout = args[0]
+		if named, ok := layouts[layout]; ok {
+			layout = named
+		}
+	}
+	if len(args) > 1 {
+		var err error
+		if loc, err = time.LoadLocation(args[1]); err != nil {
+			return "", nil, err
+		}
+	}
+	return layout, loc, nil
+}
+
+// ------------------------------------------------------------------
+
+func timeMethod(name string, f func(t time.Time) *Result) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		return f(args[0].data.(time.Time)), nil
+	}
+}
+
+func durationMethod(name string, f func(d time.Duration) *Result) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		return f(args[0].data.(time.Duration)), nil
+	}
+}
+
+func intResult(n int) *Result {
+	return &Result{kind: Integer, data: n}
+}
+
+func floatResult(f float64) *Result {
+	return &Result{kind: Float, data: float32(f)}
+}
@@ -1,6 +1,7 @@
 package gocalc
 
 import (
+	"encoding/json"
 	"fmt"
 	"unicode"
 	"unicode/utf8"
@@ -10,6 +11,7 @@ type Token int
 
 const TURE = "true"
 const FALSE = "false"
+const LET = "let"
 
 const (
 	Illegal         Token = iota
@@ -46,6 +48,23 @@ const (
 	OpBitwiseNot          // ~
 	OpAccess              // .
 	OpSeparate            // ,
+	Object                // struct, map, slice or array value
+	Whitespace            // spaces, tabs and newlines kept by Tokenize
+	Comment               // comment kept by Tokenize
+	OpAssign              // =
+	OpSemicolon           // ;
+	Let                   // let
+	OpAddAssign           // +=
+	OpMinusAssign         // -=
+	OpArrow               // => or ->
+	Func                  // lambda value
+	Time                  // time.Time value
+	Duration              // 1h30m
+	Quantity              // number with a unit of measure
+	Money                 // decimal amount in a currency
+	Complex               // 3i
+	OpPower               // **
+	OpColon               // :
 )
 
 var OperatorMap = map[string]Token{
@@ -65,6 +84,7 @@ var OperatorMap = map[string]Token{
 	"+":  OpAdd,
 	"-":  OpMinus,
 	"*":  OpMultiply,
+	"**": OpPower,
 	"/":  OpDivide,
 	"%":  OpModulus,
 	"&":  OpBitwiseAnd,
@@ -75,6 +95,13 @@ var OperatorMap = map[string]Token{
 	"~":  OpBitwiseNot,
 	".":  OpAccess,
 	",":  OpSeparate,
+	"=":  OpAssign,
+	";":  OpSemicolon,
+	"+=": OpAddAssign,
+	"-=": OpMinusAssign,
+	"=>": OpArrow,
+	"->": OpArrow,
+	":":  OpColon,
 }
 
 func GetOperator(str string) Token {
@@ -94,6 +121,28 @@ func (tok Token) MarshalJSON() ([]byte, error) {
 	return []byte(s), nil
 }
 
+func (tok *Token) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	t, ok := tokenNames[s]
+	if !ok {
+		return fmt.Errorf("unknown token[%s]", s)
+	}
+	*tok = t
+	return nil
+}
+
+// tokenNames maps the String form of every token back to the token.
+var tokenNames = func() map[string]Token {
+	names := make(map[string]Token)
+	for tok := Illegal; tok == Illegal || tok.String() != ""; tok++ {
+		names[tok.String()] = tok
+	}
+	return names
+}()
+
 func (tok Token) String() string {
 	switch tok {
 	case EOF:
@@ -164,6 +213,40 @@ func (tok Token) String() string {
 		return "."
 	case OpSeparate:
 		return ","
+	case Object:
+		return "OBJECT"
+	case Whitespace:
+		return "WHITESPACE"
+	case Comment:
+		return "COMMENT"
+	case OpAssign:
+		return "="
+	case OpSemicolon:
+		return ";"
+	case Let:
+		return "let"
+	case OpAddAssign:
+		return "+="
+	case OpMinusAssign:
+		return "-="
+	case OpArrow:
+		return "=>"
+	case Func:
+		return "FUNC"
+	case Time:
+		return "TIME"
+	case Duration:
+		return "DURATION"
+	case Quantity:
+		return "QUANTITY"
+	case Money:
+		return "MONEY"
+	case Complex:
+		return "COMPLEX"
+	case OpPower:
+		return "**"
+	case OpColon:
+		return ":"
 	}
 	return ""
 }
@@ -176,6 +259,8 @@ func OpPrecedence(Op Token) Precedence {
 	switch Op {
 	//case OpLParen, OpRParen, OpAccess:
 	//	return 1
+	case OpPower:
+		return 1
 	case OpNot, OpBitwiseNot:
 		return 2
 	case OpMultiply, OpDivide, OpModulus:
@@ -208,6 +293,22 @@ func (p Precedence) PrecedenceWith(p2 Precedence) bool {
 	return p < p2
 }
 
+func isAssignOp(Op Token) bool {
+	switch Op {
+	case OpAssign, OpAddAssign, OpMinusAssign:
+		return true
+	}
+	return false
+}
+
+func isUnaryOp(Op Token) bool {
+	switch Op {
+	case OpAdd, OpMinus, OpNot, OpBitwiseXor, OpBitwiseNot:
+		return true
+	}
+	return false
+}
+
 // ------------------------------------------------------------------
 
 func IsVariableChar(c rune) bool {
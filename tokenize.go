@@ -0,0 +1,204 @@
+package gocalc
+
+import (
+	"fmt"
+)
+
+// TokenInfo describes a token of the source text.
+type TokenInfo struct {
+	Kind    Token
+	Literal string   // source text of the token
+	Pos     Position // position of the first rune
+	End     Position // position right after the last rune
+}
+
+// TokenizeOptions selects the tokens returned by Tokenize.
+type TokenizeOptions struct {
+	// KeepWhitespace returns each run of whitespace as a Whitespace token,
+	// so that the literals of the tokens add up to the source text.
+	KeepWhitespace bool
+	// KeepComments returns each comment as a Comment token.
+	KeepComments bool
+}
+
+// Tokenize splits src into tokens without parsing it. Illegal tokens are
+// returned along with the others, so that tools such as syntax
+// highlighters cover the whole source, and the error reports the first
+// of them.
+func Tokenize(src string) ([]TokenInfo, error) {
+	return TokenizeWithOptions(src, TokenizeOptions{})
+}
+
+// TokenizeWithOptions is like Tokenize but returns the tokens selected by
+// opts.
+func TokenizeWithOptions(src string, opts TokenizeOptions) ([]TokenInfo, error) {
+	t := NewTokenizer(src, opts)
+	return t.Tokens(), t.Err()
+}
+
+// ------------------------------------------------------------------
+
+// Tokenizer keeps the tokens of a source text up to date while the text is
+// edited. Edit re-lexes the text from the last token that cannot be
+// affected by the change, and stops as soon as it is back at the start of
+// a token that followed the change: the remaining tokens are reused with
+// their positions shifted.
+type Tokenizer struct {
+	opts   TokenizeOptions
+	source []rune
+	tokens []TokenInfo
+}
+
+// NewTokenizer returns a Tokenizer holding the tokens of src.
+func NewTokenizer(src string, opts TokenizeOptions) *Tokenizer {
+	t := &Tokenizer{
+		opts:   opts,
+		source: []rune(src),
+	}
+	t.tokens = t.lex(Position{Offset: 0, Line: 1, Column: 1}, nil, 0)
+	return t
+}
+
+// Source returns the current source text.
+func (t *Tokenizer) Source() string {
+	return string(t.source)
+}
+
+// Tokens returns the tokens of the current source text. The slice must not
+// be modified.
+func (t *Tokenizer) Tokens() []TokenInfo {
+	return t.tokens
+}
+
+// Err returns an error for the first illegal token, or nil.
+func (t *Tokenizer) Err() error {
+	for _, tok := range t.tokens {
+		if tok.Kind == Illegal {
+			return &Error{
+				Pos: tok.Pos,
+				End: tok.End,
+				Err: fmt.Errorf("illegal token[%s]", tok.Literal),
+			}
+		}
+	}
+	return nil
+}
+
+// Edit replaces the n runes at rune offset off of the source text with
+// text, and returns the updated tokens as Tokens and Err do.
+func (t *Tokenizer) Edit(off, n int, text string) ([]TokenInfo, error) {
+	if off < 0 || n < 0 || off+n > len(t.source) {
+		return nil, fmt.Errorf("wrong edit range[%d:%d]", off, off+n)
+	}
+	insert := []rune(text)
+	end := off + n
+
+	source := make([]rune, 0, len(t.source)-n+len(insert))
+	source = append(source, t.source[:off]...)
+	source = append(source, insert...)
+	source = append(source, t.source[end:]...)
+	t.source = source
+
+	// A token is decided by its runes and the rune right after it, so
+	// the tokens ending before off are kept as they are.
+	keep := 0
+	for keep < len(t.tokens) && t.tokens[keep].End.Offset < off {
+		keep++
+	}
+	from := Position{Offset: 0, Line: 1, Column: 1}
+	if keep > 0 {
+		from = t.tokens[keep-1].End
+	}
+	after := keep
+	for after < len(t.tokens) && t.tokens[after].Pos.Offset < end {
+		after++
+	}
+
+	tail := t.lex(from, t.tokens[after:], len(insert)-n)
+	if keep > 0 {
+		tail = append(t.tokens[:keep:keep], tail...)
+	}
+	t.tokens = tail
+	return t.Tokens(), t.Err()
+}
+
+// lex scans the source text from pos. old holds the tokens that followed
+// the edited text, whose offsets are delta runes off: once lex reaches the
+// start of one of them, the rest of the source is known to scan the same,
+// so those tokens are reused instead.
+func (t *Tokenizer) lex(pos Position, old []TokenInfo, delta int) []TokenInfo {
+	var toks []TokenInfo
+	s := newScannerAt(t.source, pos)
+	for {
+		t.skip(s)
+		start := s.pos()
+		for len(old) > 0 && old[0].Pos.Offset+delta < start.Offset {
+			old = old[1:]
+		}
+		if len(old) > 0 && old[0].Pos.Offset+delta == start.Offset {
+			return append(toks, shiftTokens(old, start)...)
+		}
+
+		tok := t.scan(s)
+		if tok == EOF {
+			return toks
+		}
+		end := s.pos()
+		toks = append(toks, TokenInfo{
+			Kind:    tok,
+			Literal: string(t.source[start.Offset:end.Offset]),
+			Pos:     start,
+			End:     end,
+		})
+	}
+}
+
+// skip skips the whitespace and comments that are not kept.
+func (t *Tokenizer) skip(s *scanner) {
+	for {
+		switch {
+		case !t.opts.KeepWhitespace && IsSpace(s.char):
+			s.skipSpace()
+		case !t.opts.KeepComments && s.skipComment():
+		default:
+			return
+		}
+	}
+}
+
+func (t *Tokenizer) scan(s *scanner) Token {
+	switch {
+	case t.opts.KeepWhitespace && IsSpace(s.char):
+		s.skipSpace()
+		return Whitespace
+	case t.opts.KeepComments && s.isComment():
+		if !s.scanComment() {
+			return Illegal
+		}
+		return Comment
+	}
+	tok, _ := s.scan()
+	return tok
+}
+
+// shiftTokens returns a copy of toks moved so that the first one starts
+// at pos. Columns only change on the line of the first token.
+func shiftTokens(toks []TokenInfo, pos Position) []TokenInfo {
+	from := toks[0].Pos
+	shifted := make([]TokenInfo, len(toks))
+	for i, tok := range toks {
+		tok.Pos = shiftPos(tok.Pos, from, pos)
+		tok.End = shiftPos(tok.End, from, pos)
+		shifted[i] = tok
+	}
+	return shifted
+}
+
+func shiftPos(p, from, to Position) Position {
+	if p.Line == from.Line {
+		p.Column += to.Column - from.Column
+	}
+	p.Line += to.Line - from.Line
+	p.Offset += to.Offset - from.Offset
+	return p
+}
@@ -0,0 +1,133 @@
+package gocalc
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	toks, err := Tokenize("a.b >=\n  1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, tok := range toks {
+		got = append(got, tok.Kind.String()+" "+tok.Literal+" "+tok.Pos.String()+"-"+tok.End.String())
+	}
+	want := []string{
+		"IDENT a 1:1-1:2",
+		". . 1:2-1:3",
+		"IDENT b 1:3-1:4",
+		">= >= 1:5-1:7",
+		"FLOAT 1.5 2:3-2:6",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	src := " x +\t\"s\" \n"
+	toks, _ = TokenizeWithOptions(src, TokenizeOptions{KeepWhitespace: true})
+	var b strings.Builder
+	for _, tok := range toks {
+		b.WriteString(tok.Literal)
+	}
+	if b.String() != src || toks[0].Kind != Whitespace {
+		t.Errorf("got %+v, want the whole source back", toks)
+	}
+
+	toks, _ = TokenizeWithOptions("a /* b */ + 1 // c", TokenizeOptions{KeepComments: true})
+	if len(toks) != 5 || toks[1].Kind != Comment || toks[1].Literal != "/* b */" || toks[4].Literal != "// c" {
+		t.Errorf("got %+v, want the comments kept", toks)
+	}
+	if toks, _ = Tokenize("a /* b */ + 1 // c"); len(toks) != 3 {
+		t.Errorf("got %+v, want the comments skipped", toks)
+	}
+
+	toks, err = Tokenize(`a # 1`)
+	if perr, ok := err.(*Error); !ok || perr.Pos.String() != "1:3" {
+		t.Errorf("got %v, want an illegal token at 1:3", err)
+	}
+	if len(toks) != 3 || toks[2].Kind != Integer {
+		t.Errorf("expected the tokens after the illegal one, got %+v", toks)
+	}
+}
+
+var allTokenizeOptions = []TokenizeOptions{
+	{},
+	{KeepWhitespace: true},
+	{KeepComments: true},
+	{KeepWhitespace: true, KeepComments: true},
+}
+
+func TestTokenizerEdit(t *testing.T) {
+	tests := []struct {
+		src  string
+		off  int
+		n    int
+		text string
+	}{
+		{`ab + 1`, 2, 0, "c"},
+		{`ab + 1`, 0, 0, "x"},
+		{`a + 1`, 1, 1, ""},
+		{`a +` + "\n" + `b * c`, 3, 1, " "},
+		{`x < y`, 2, 0, "<"},
+		{`1. + 2`, 2, 0, "5"},
+		{`"abc" + d`, 4, 1, ""},
+		{`a + b`, 0, 5, `"x"`},
+		{`a.b[0] || c`, 6, 0, "\n\n"},
+		{`a /* b */ + c`, 8, 1, ""},
+		{`a // b` + "\n" + `+ c`, 6, 1, ""},
+		{`a / b`, 3, 0, "*"},
+	}
+
+	for _, opts := range allTokenizeOptions {
+		for _, tt := range tests {
+			tz := NewTokenizer(tt.src, opts)
+			got, gotErr := tz.Edit(tt.off, tt.n, tt.text)
+
+			src := []rune(tt.src)
+			edited := string(src[:tt.off]) + tt.text + string(src[tt.off+tt.n:])
+			want, wantErr := TokenizeWithOptions(edited, opts)
+			if tz.Source() != edited {
+				t.Errorf("%q: got source %q, want %q", tt.src, tz.Source(), edited)
+			}
+			if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotErr, wantErr) {
+				t.Errorf("%q %+v: got %+v %v, want %+v %v", edited, opts, got, gotErr, want, wantErr)
+			}
+		}
+	}
+
+	if _, err := NewTokenizer("a", TokenizeOptions{}).Edit(1, 1, ""); err == nil {
+		t.Errorf("expected an error for an edit out of range")
+	}
+}
+
+func TestTokenizerRandomEdits(t *testing.T) {
+	const alphabet = "ab1. \n+-<=!&|\"'\\()[]/*"
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, opts := range allTokenizeOptions {
+		tz := NewTokenizer(`a.b[1] + "s" <= 2.5`, opts)
+		for i := 0; i < 2000; i++ {
+			size := len([]rune(tz.Source()))
+			off := rnd.Intn(size + 1)
+			n := rnd.Intn(size - off + 1)
+			if n > 3 {
+				n = 3
+			}
+			text := make([]byte, rnd.Intn(4))
+			for j := range text {
+				text[j] = alphabet[rnd.Intn(len(alphabet))]
+			}
+
+			got, _ := tz.Edit(off, n, string(text))
+			want, _ := TokenizeWithOptions(tz.Source(), opts)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%q: got %+v, want %+v", tz.Source(), got, want)
+			}
+		}
+	}
+}
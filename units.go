@@ -0,0 +1,496 @@
+package gocalc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Measure is the value of a Quantity: a number in a unit of measure, such
+// as 9.8 m/s^2. Unit is written as names with optional exponents joined by
+// * and /, in the notation of unit literals.
+type Measure struct {
+	Value float64
+	Unit  string
+}
+
+func (m Measure) String() string {
+	return strconv.FormatFloat(m.Value, 'g', -1, 64) + " " + m.Unit
+}
+
+// dimension maps each base unit to its exponent, such as m:1 s:-1 for a
+// velocity. Exponents are never zero.
+type dimension map[string]int
+
+func (d dimension) equal(o dimension) bool {
+	if len(d) != len(o) {
+		return false
+	}
+	for base, exp := range d {
+		if o[base] != exp {
+			return false
+		}
+	}
+	return true
+}
+
+// unitDef defines a unit as factor times the base units of dim.
+type unitDef struct {
+	factor float64
+	dim    dimension
+}
+
+var (
+	unitsMu sync.RWMutex
+	units   = make(map[string]unitDef)
+)
+
+func init() {
+	for _, def := range []struct {
+		name   string
+		factor float64
+		base   string
+	}{
+		{"m", 1, ""}, {"kg", 1, ""}, {"s", 1, ""}, {"A", 1, ""},
+		{"K", 1, ""}, {"mol", 1, ""}, {"cd", 1, ""},
+
+		{"km", 1000, "m"}, {"cm", 0.01, "m"}, {"mm", 0.001, "m"},
+		{"mi", 1609.344, "m"}, {"yd", 0.9144, "m"}, {"ft", 0.3048, "m"}, {"in", 0.0254, "m"},
+		{"g", 0.001, "kg"}, {"mg", 1e-6, "kg"}, {"t", 1000, "kg"},
+		{"lb", 0.45359237, "kg"}, {"oz", 0.028349523125, "kg"},
+		{"ms", 0.001, "s"}, {"min", 60, "s"}, {"h", 3600, "s"}, {"d", 86400, "s"},
+		{"L", 0.001, "m^3"}, {"mL", 1e-6, "m^3"},
+		{"Hz", 1, "s^-1"},
+		{"N", 1, "kg*m/s^2"},
+		{"Pa", 1, "N/m^2"}, {"kPa", 1000, "Pa"}, {"bar", 1e5, "Pa"},
+		{"J", 1, "N*m"}, {"kJ", 1000, "J"},
+		{"W", 1, "J/s"}, {"kW", 1000, "W"},
+		{"Wh", 3600, "J"}, {"kWh", 3.6e6, "J"},
+		{"V", 1, "W/A"},
+	} {
+		if err := RegisterUnit(def.name, def.factor, def.base); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterUnit defines the unit name as factor times the unit base, as in
+// RegisterUnit("lb", 0.45359237, "kg") or RegisterUnit("kn", 1852, "m/h").
+// An empty base makes name a new base unit, whose quantities only combine
+// with quantities of the same dimension. Units are multiplicative, so
+// scales with an offset such as degrees Celsius cannot be defined. It is
+// safe to call while expressions are evaluated.
+func RegisterUnit(name string, factor float64, base string) error {
+	if !isUnitName(name) {
+		return fmt.Errorf("wrong unit name[%s]", name)
+	}
+	if !(factor > 0) || math.IsInf(factor, 1) {
+		return fmt.Errorf("wrong unit factor[%v]", factor)
+	}
+
+	def := unitDef{factor: factor, dim: dimension{name: 1}}
+	if base != "" {
+		terms, err := parseUnit(base)
+		if err != nil {
+			return err
+		}
+		if def, err = resolveUnit(terms); err != nil {
+			return err
+		}
+		def.factor *= factor
+	}
+
+	unitsMu.Lock()
+	defer unitsMu.Unlock()
+	if _, ok := units[name]; ok {
+		return fmt.Errorf("unit[%s] already defined", name)
+	}
+	units[name] = def
+	return nil
+}
+
+// ------------------------------------------------------------------
+
+// unitTerm is a unit name raised to a non-zero power.
+type unitTerm struct {
+	name string
+	exp  int
+}
+
+// parseUnit reads the text of a unit, such as kg*m/s^2, into its terms.
+// Terms of the same name are merged.
+func parseUnit(s string) ([]unitTerm, error) {
+	var terms []unitTerm
+	sign := 1
+	rest := s
+	for {
+		i := 0
+		for i < len(rest) && !strings.ContainsRune("*/^", rune(rest[i])) {
+			i++
+		}
+		name := rest[:i]
+		if !isUnitName(name) {
+			return nil, fmt.Errorf("wrong unit[%s]", s)
+		}
+		rest = rest[i:]
+
+		exp := 1
+		if strings.HasPrefix(rest, "^") {
+			j := 1
+			if strings.HasPrefix(rest[j:], "-") {
+				j++
+			}
+			for j < len(rest) && IsDecimal(rune(rest[j])) {
+				j++
+			}
+			var err error
+			if exp, err = strconv.Atoi(rest[1:j]); err != nil || exp == 0 {
+				return nil, fmt.Errorf("wrong unit[%s]", s)
+			}
+			rest = rest[j:]
+		}
+		terms = combineUnits(terms, []unitTerm{{name, exp}}, sign)
+
+		if rest == "" {
+			if len(terms) == 0 {
+				return nil, fmt.Errorf("wrong unit[%s], the terms cancel out", s)
+			}
+			return terms, nil
+		}
+		switch rest[0] {
+		case '*':
+			sign = 1
+		case '/':
+			sign = -1
+		default:
+			return nil, fmt.Errorf("wrong unit[%s]", s)
+		}
+		rest = rest[1:]
+	}
+}
+
+func isUnitName(name string) bool {
+	for i, c := range name {
+		if !(IsLetter(c) || c == '_' || i > 0 && IsDecimal(c)) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// formatUnit writes terms in the notation read by parseUnit: the terms of
+// positive powers first, then each of the others after a /.
+func formatUnit(terms []unitTerm) string {
+	var num, den []string
+	for _, t := range terms {
+		switch {
+		case t.exp == 1 || t.exp == -1:
+			if t.exp > 0 {
+				num = append(num, t.name)
+			} else {
+				den = append(den, t.name)
+			}
+		case t.exp > 0:
+			num = append(num, t.name+"^"+strconv.Itoa(t.exp))
+		default:
+			den = append(den, t.name+"^"+strconv.Itoa(-t.exp))
+		}
+	}
+	if len(num) == 0 {
+		// nothing to divide: write negative powers, as in s^-1
+		parts := make([]string, len(terms))
+		for i, t := range terms {
+			parts[i] = t.name + "^" + strconv.Itoa(t.exp)
+		}
+		return strings.Join(parts, "*")
+	}
+	s := strings.Join(num, "*")
+	for _, d := range den {
+		s += "/" + d
+	}
+	return s
+}
+
+// combineUnits returns the terms of a multiplied by b, or divided by b if
+// sign is -1.
+func combineUnits(a, b []unitTerm, sign int) []unitTerm {
+	out := append([]unitTerm(nil), a...)
+next:
+	for _, t := range b {
+		for i := range out {
+			if out[i].name == t.name {
+				out[i].exp += sign * t.exp
+				continue next
+			}
+		}
+		out = append(out, unitTerm{t.name, sign * t.exp})
+	}
+
+	n := 0
+	for _, t := range out {
+		if t.exp != 0 {
+			out[n] = t
+			n++
+		}
+	}
+	return out[:n]
+}
+
+// resolveUnit returns the factor and dimension of a unit.
+func resolveUnit(terms []unitTerm) (unitDef, error) {
+	unitsMu.RLock()
+	defer unitsMu.RUnlock()
+
+	def := unitDef{factor: 1, dim: make(dimension)}
+	for _, t := range terms {
+		u, ok := units[t.name]
+		if !ok {
+			return unitDef{}, fmt.Errorf("unknown unit[%s]", t.name)
+		}
+		def.factor *= math.Pow(u.factor, float64(t.exp))
+		for base, exp := range u.dim {
+			if def.dim[base] += exp * t.exp; def.dim[base] == 0 {
+				delete(def.dim, base)
+			}
+		}
+	}
+	return def, nil
+}
+
+// ------------------------------------------------------------------
+
+// calcUnitExpr evaluates a quantity or, when the unit is a currency code,
+// an amount of money such as 12.50 EUR.
+func (e *evaluator) calcUnitExpr(expr *UnitExpr) (*Result, error) {
+	if _, currency := currencyDigits(expr.Unit); currency {
+		x, err := e.calcAmount(expr.X)
+		if err != nil {
+			return nil, err
+		}
+		return newMoney(x, expr.Unit)
+	}
+
+	// keep the full precision of the literal, which a Float would not
+	if lit, ok := expr.X.(*LiteralExpr); ok {
+		if v, ok := lit.Date.(float64); ok {
+			return newMeasure(v, expr.Unit)
+		}
+	}
+	x, err := e.calcExpr(expr.X)
+	if err != nil {
+		return nil, err
+	}
+	return newQuantity(x, expr.Unit)
+}
+
+// newQuantity attaches unit to the number x.
+func newQuantity(x *Result, unit string) (*Result, error) {
+	v, ok := number(x)
+	if !ok {
+		return nil, fmt.Errorf("wrong quantity value[%v]", x.kind)
+	}
+	return newMeasure(v, unit)
+}
+
+func newMeasure(v float64, unit string) (*Result, error) {
+	terms, err := parseUnit(unit)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := resolveUnit(terms); err != nil {
+		return nil, err
+	}
+	return &Result{kind: Quantity, data: Measure{Value: v, Unit: formatUnit(terms)}}, nil
+}
+
+// number returns the value of an Integer or a Float.
+func number(r *Result) (float64, bool) {
+	switch v := r.data.(type) {
+	case int:
+		return float64(v), r.kind == Integer
+	case float32:
+		return float64(v), r.kind == Float
+	}
+	return 0, false
+}
+
+// measureOf returns the measure of a Quantity with its terms and
+// definition.
+func measureOf(r *Result) (Measure, []unitTerm, unitDef, error) {
+	m := r.data.(Measure)
+	terms, err := parseUnit(m.Unit)
+	if err != nil {
+		return m, nil, unitDef{}, err
+	}
+	def, err := resolveUnit(terms)
+	return m, terms, def, err
+}
+
+// convertMeasure returns the value of m, whose unit is defined by from, in
+// the unit defined by to.
+func convertMeasure(m Measure, from, to unitDef) (float64, error) {
+	if !from.dim.equal(to.dim) {
+		return 0, errors.New("incompatible units")
+	}
+	return m.Value * from.factor / to.factor, nil
+}
+
+// quantityBinary applies op to operands one of which at least is a
+// Quantity. Quantities are added, subtracted and compared in the unit of
+// the left one; products and quotients combine the units, and are plain
+// floats when the dimensions cancel out.
+func quantityBinary(op Token, l, r *Result) (*Result, error) {
+	if l.kind != Quantity {
+		x, ok := number(l)
+		if !ok || (op != OpMultiply && op != OpDivide) {
+			return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+		}
+		m, terms, _, err := measureOf(r)
+		if err != nil {
+			return nil, err
+		}
+		if op == OpMultiply {
+			return &Result{kind: Quantity, data: Measure{Value: x * m.Value, Unit: m.Unit}}, nil
+		}
+		if m.Value == 0 {
+			return nil, errors.New("division by zero")
+		}
+		inverse := combineUnits(nil, terms, -1)
+		return &Result{kind: Quantity, data: Measure{Value: x / m.Value, Unit: formatUnit(inverse)}}, nil
+	}
+
+	lm, lterms, ldef, err := measureOf(l)
+	if err != nil {
+		return nil, err
+	}
+	if r.kind != Quantity {
+		y, ok := number(r)
+		if !ok || (op != OpMultiply && op != OpDivide) {
+			return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+		}
+		if op == OpDivide {
+			if y == 0 {
+				return nil, errors.New("division by zero")
+			}
+			y = 1 / y
+		}
+		return &Result{kind: Quantity, data: Measure{Value: lm.Value * y, Unit: lm.Unit}}, nil
+	}
+
+	rm, rterms, rdef, err := measureOf(r)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case OpMultiply, OpDivide:
+		sign, v := 1, lm.Value*rm.Value
+		if op == OpDivide {
+			if rm.Value == 0 {
+				return nil, errors.New("division by zero")
+			}
+			sign, v = -1, lm.Value/rm.Value
+		}
+		terms := combineUnits(lterms, rterms, sign)
+		def, err := resolveUnit(terms)
+		if err != nil {
+			return nil, err
+		}
+		if len(def.dim) == 0 {
+			return &Result{kind: Float, data: float32(v * def.factor)}, nil
+		}
+		return &Result{kind: Quantity, data: Measure{Value: v, Unit: formatUnit(terms)}}, nil
+	}
+
+	y, err := convertMeasure(rm, rdef, ldef)
+	if err != nil {
+		return nil, fmt.Errorf("incompatible units[%s %s %s]", lm.Unit, op, rm.Unit)
+	}
+	switch op {
+	case OpAdd:
+		return &Result{kind: Quantity, data: Measure{Value: lm.Value + y, Unit: lm.Unit}}, nil
+	case OpMinus:
+		return &Result{kind: Quantity, data: Measure{Value: lm.Value - y, Unit: lm.Unit}}, nil
+	case OpEq, OpNeq, OpGt, OpLt, OpGte, OpLte:
+		return compareResult(op, compareFloat(lm.Value, y)), nil
+	}
+	return nil, fmt.Errorf("wrong binary expression[%v %s %v]", l.kind, op, r.kind)
+}
+
+// compareQuantity orders two quantities of the same dimension.
+func compareQuantity(a, b *Result) (int, error) {
+	am, _, adef, err := measureOf(a)
+	if err != nil {
+		return 0, err
+	}
+	bm, _, bdef, err := measureOf(b)
+	if err != nil {
+		return 0, err
+	}
+	y, err := convertMeasure(bm, bdef, adef)
+	if err != nil {
+		return 0, fmt.Errorf("cannot compare %s and %s", am.Unit, bm.Unit)
+	}
+	return compareFloat(am.Value, y), nil
+}
+
+// ------------------------------------------------------------------
+
+// builtinTo converts to(q, unit), as in to(5 kg, "lb"), or an amount of
+// money to another currency.
+func builtinTo(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("to", args, 2, 2); err != nil {
+		return nil, err
+	}
+	unit, ok := args[1].data.(string)
+	if a, isMoney := args[0].data.(Amount); isMoney && ok {
+		converted, err := e.convertMoney(a, unit)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{kind: Money, data: converted}, nil
+	}
+	if args[0].kind != Quantity || args[1].kind != String || !ok {
+		return nil, fmt.Errorf("to: wrong argument types[%v, %v]", args[0].kind, args[1].kind)
+	}
+	m, _, from, err := measureOf(args[0])
+	if err != nil {
+		return nil, err
+	}
+	terms, err := parseUnit(unit)
+	if err != nil {
+		return nil, err
+	}
+	to, err := resolveUnit(terms)
+	if err != nil {
+		return nil, err
+	}
+	v, err := convertMeasure(m, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("to: cannot convert %s to %s", m.Unit, unit)
+	}
+	return &Result{kind: Quantity, data: Measure{Value: v, Unit: formatUnit(terms)}}, nil
+}
+
+// builtinQuantity attaches a unit to a number: quantity(x, "kg").
+func builtinQuantity(e *evaluator, args []*Result) (*Result, error) {
+	if err := checkArgs("quantity", args, 2, 2); err != nil {
+		return nil, err
+	}
+	unit, ok := args[1].data.(string)
+	if args[1].kind != String || !ok {
+		return nil, fmt.Errorf("quantity: wrong argument type[%v]", args[1].kind)
+	}
+	return newQuantity(args[0], unit)
+}
+
+func quantityMethod(name string, f func(m Measure) *Result) builtin {
+	return func(e *evaluator, args []*Result) (*Result, error) {
+		if err := checkArgs(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		return f(args[0].data.(Measure)), nil
+	}
+}
@@ -0,0 +1,238 @@
+package gocalc
+
+import (
+	"fmt"
+)
+
+// A Visitor's Visit method is invoked for each node encountered by Walk.
+// If the result visitor w is not nil, Walk visits each of the children
+// of node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(e Expr) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(e); e must not be nil. If the visitor w returned by v.Visit(e)
+// is not nil, Walk is invoked recursively with visitor w for each of the
+// non-nil children of e, followed by a call of w.Visit(nil).
+func Walk(v Visitor, e Expr) {
+	if v = v.Visit(e); v == nil {
+		return
+	}
+
+	switch n := e.(type) {
+	case *LiteralExpr, *IdentExpr:
+		// nothing to do
+	case *AccessExpr:
+		walkIf(v, n.E)
+		Walk(v, &n.Access)
+	case *IndexExpr:
+		walkIf(v, n.E)
+		walkIf(v, n.Index)
+	case *SliceExpr:
+		walkIf(v, n.E)
+		walkIf(v, n.Lo)
+		walkIf(v, n.Hi)
+	case *BinaryExpr:
+		walkIf(v, n.LE)
+		walkIf(v, n.RE)
+	case *ParenExpr:
+		walkIf(v, n.E)
+	case *UnaryExpr:
+		walkIf(v, n.E)
+	case *LetExpr:
+		Walk(v, &n.Name)
+		walkIf(v, n.Value)
+	case *AssignExpr:
+		walkIf(v, n.Target)
+		walkIf(v, n.Value)
+	case *LambdaExpr:
+		for i := range n.Params {
+			Walk(v, &n.Params[i])
+		}
+		walkIf(v, n.Body)
+	case *UnitExpr:
+		walkIf(v, n.X)
+	case *CallExpr:
+		walkIf(v, n.Fun)
+		for _, arg := range n.Args {
+			walkIf(v, arg)
+		}
+	case *Program:
+		for _, stmt := range n.Stmts {
+			walkIf(v, stmt)
+		}
+	default:
+		panic(fmt.Sprintf("gocalc.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkIf(v Visitor, e Expr) {
+	if e != nil {
+		Walk(v, e)
+	}
+}
+
+type inspector func(Expr) bool
+
+func (f inspector) Visit(e Expr) Visitor {
+	if f(e) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(e); e must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of e, followed by a
+// call of f(nil).
+func Inspect(e Expr, f func(Expr) bool) {
+	Walk(inspector(f), e)
+}
+
+// ------------------------------------------------------------------
+
+// Rewrite returns the tree obtained by replacing every node n of e with
+// f(n). Children are rewritten before their parent, and f receives a
+// node whose children are already rewritten. The input tree is never
+// modified: a node is copied only when one of its children changes.
+//
+// The member name of an AccessExpr, the name bound by a LetExpr and the
+// parameters of a LambdaExpr are passed to f as an *IdentExpr; if f
+// returns anything other than an *IdentExpr for them, the name is kept.
+func Rewrite(e Expr, f func(Expr) Expr) Expr {
+	if e == nil {
+		return nil
+	}
+
+	switch n := e.(type) {
+	case *AccessExpr:
+		x := Rewrite(n.E, f)
+		access := n.Access
+		if id, ok := f(&access).(*IdentExpr); ok && id != nil {
+			access = *id
+		}
+		if x != n.E || access != n.Access {
+			c := *n
+			c.E, c.Access = x, access
+			e = &c
+		}
+	case *IndexExpr:
+		x, index := Rewrite(n.E, f), Rewrite(n.Index, f)
+		if x != n.E || index != n.Index {
+			c := *n
+			c.E, c.Index = x, index
+			e = &c
+		}
+	case *SliceExpr:
+		x, lo, hi := Rewrite(n.E, f), Rewrite(n.Lo, f), Rewrite(n.Hi, f)
+		if x != n.E || lo != n.Lo || hi != n.Hi {
+			c := *n
+			c.E, c.Lo, c.Hi = x, lo, hi
+			e = &c
+		}
+	case *BinaryExpr:
+		le, re := Rewrite(n.LE, f), Rewrite(n.RE, f)
+		if le != n.LE || re != n.RE {
+			c := *n
+			c.LE, c.RE = le, re
+			e = &c
+		}
+	case *ParenExpr:
+		if x := Rewrite(n.E, f); x != n.E {
+			c := *n
+			c.E = x
+			e = &c
+		}
+	case *UnaryExpr:
+		if x := Rewrite(n.E, f); x != n.E {
+			c := *n
+			c.E = x
+			e = &c
+		}
+	case *LetExpr:
+		name := n.Name
+		if id, ok := f(&name).(*IdentExpr); ok && id != nil {
+			name = *id
+		}
+		value := Rewrite(n.Value, f)
+		if name != n.Name || value != n.Value {
+			c := *n
+			c.Name, c.Value = name, value
+			e = &c
+		}
+	case *AssignExpr:
+		target, value := Rewrite(n.Target, f), Rewrite(n.Value, f)
+		if target != n.Target || value != n.Value {
+			c := *n
+			c.Target, c.Value = target, value
+			e = &c
+		}
+	case *LambdaExpr:
+		var params []IdentExpr // copied on the first change
+		for i := range n.Params {
+			param := n.Params[i]
+			if id, ok := f(&param).(*IdentExpr); ok && id != nil {
+				param = *id
+			}
+			if param != n.Params[i] && params == nil {
+				params = append([]IdentExpr(nil), n.Params...)
+			}
+			if params != nil {
+				params[i] = param
+			}
+		}
+		body := Rewrite(n.Body, f)
+		if params != nil || body != n.Body {
+			c := *n
+			if params != nil {
+				c.Params = params
+			}
+			c.Body = body
+			e = &c
+		}
+	case *UnitExpr:
+		if x := Rewrite(n.X, f); x != n.X {
+			c := *n
+			c.X = x
+			e = &c
+		}
+	case *CallExpr:
+		fun := Rewrite(n.Fun, f)
+		args, changed := rewriteList(n.Args, f)
+		if fun != n.Fun || changed {
+			c := *n
+			c.Fun, c.Args = fun, args
+			e = &c
+		}
+	case *Program:
+		if stmts, changed := rewriteList(n.Stmts, f); changed {
+			c := *n
+			c.Stmts = stmts
+			e = &c
+		}
+	}
+
+	return f(e)
+}
+
+// rewriteList rewrites the nodes of list, which is copied on the first
+// change.
+func rewriteList(list []Expr, f func(Expr) Expr) ([]Expr, bool) {
+	var out []Expr
+	for i, x := range list {
+		y := Rewrite(x, f)
+		if y != x && out == nil {
+			out = append([]Expr(nil), list...)
+		}
+		if out != nil {
+			out[i] = y
+		}
+	}
+	if out == nil {
+		return list, false
+	}
+	return out, true
+}